@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -15,6 +18,11 @@ func init() {
 	RootCmd.AddCommand(agentCmd)
 }
 
+type teamKeys struct {
+	team string
+	data []gskp.UserInfo
+}
+
 var agentCmd = &cobra.Command{
 	Use:   "agent",
 	Short: "starts the agent",
@@ -22,61 +30,246 @@ var agentCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		simplelog.Infof("starting up")
 
-		for _, cv := range []string{"agentGithubTeam", "collectorBaseURL", "authorizedKeysPath"} {
+		for _, cv := range []string{"collectorBaseURL", "authorizedKeysPath"} {
 			if viper.GetString(cv) == "" {
 				simplelog.Errorf("please specify a config value for %s", cv)
 				os.Exit(-1)
 			}
 		}
 
+		teams := agentTeams()
+		if len(teams) == 0 {
+			simplelog.Errorf("please specify a config value for agentGithubTeams or agentGithubTeam")
+			os.Exit(-1)
+		}
+
+		client, err := newAgentClient()
+		if err != nil {
+			simplelog.Errorf("could not create a client instance, exiting: %v", err)
+			os.Exit(-1)
+		}
+
+		// the gRPC client holds a connection that has to be closed
+		closeClient := func() {}
+		if closer, ok := client.(io.Closer); ok {
+			closeClient = func() {
+				if err := closer.Close(); err != nil {
+					simplelog.Errorf("could not close the client: %v", err)
+				}
+			}
+		}
+		defer closeClient()
+
 		// handle interrupt
 		sigChannel := make(chan os.Signal, 1)
 		signal.Notify(sigChannel, os.Interrupt)
 		go func() {
 			<-sigChannel
 			simplelog.Infof("received interrupt: shutting down")
+			closeClient()
 			os.Exit(0)
 		}()
 
-		client, err := gskp.NewClient(viper.GetString("collectorBaseURL"), viper.GetInt64("agentLongpollTimeoutSeconds"))
-		if err != nil {
-			simplelog.Errorf("could not create a client instance: %v", err)
+		updates := make(chan teamKeys)
+		httpClient, poll := client.(*gskp.Client)
+		poll = poll && !viper.GetBool("agentStreamUpdates")
+		watch := func(team string) {
+			if poll {
+				pollTeam(httpClient, team, updates)
+			} else {
+				streamTeam(client, team, updates)
+			}
 		}
 
-		for {
-			data, err := client.GetKeys(viper.GetString("agentGithubTeam"))
+		// teams that cannot be fetched at startup are retried in the background,
+		// so that they do not hold back the keys of the others
+		teamData := map[string][]gskp.UserInfo{}
+		for _, team := range teams {
+			data, err := getTeamKeys(client, team)
 			if err != nil {
-				simplelog.Errorf("error while trying to bootstrap with initial keys, will try again in a minute: %v", err)
-				time.Sleep(time.Minute)
-			} else {
-				updateAuthorizedKeys(data)
-				break
+				simplelog.Errorf("error while trying to bootstrap with initial keys for team '%s', will try again in a minute: %v", team, err)
+				go bootstrapTeam(client, team, updates, watch)
+				continue
 			}
+
+			teamData[team] = data
+			go watch(team)
 		}
+		// access that was already granted before the agent started is not logged
+		authorized := mergeTeamData(teams, teamData)
+		updateAuthorizedKeys(authorized)
 
-		simplelog.Infof("starting poll for ssh key updates")
-		for {
-			simplelog.Debugf("starting longpoll request")
-			data, err := client.PollForKeys(viper.GetString("agentGithubTeam"))
-			if err == gskp.ErrClientPollTimeout {
-				simplelog.Debugf("longpoll timeout, will re-start")
-				continue
-			} else if err != nil {
-				simplelog.Errorf("error while polling for key changes, ignoring and retrying in 15 seconds: %v", err)
-				time.Sleep(15 * time.Second)
-			} else {
-				updateAuthorizedKeys(data)
+		if poll {
+			simplelog.Infof("starting poll for ssh key updates for teams: %s", strings.Join(teams, ", "))
+		} else {
+			simplelog.Infof("starting stream of ssh key updates for teams: %s", strings.Join(teams, ", "))
+		}
+
+		for update := range updates {
+			teamData[update.team] = update.data
+
+			merged := mergeTeamData(teams, teamData)
+			if err := updateAuthorizedKeys(merged); err == nil {
+				logKeyDiff(gskp.DiffUserInfo(authorized, merged))
+				authorized = merged
 			}
 		}
 	},
 }
 
-func updateAuthorizedKeys(data []gskp.UserInfo) {
+// newAgentClient creates the client the agent gets keys from. The collector's
+// gRPC API is used if agentCollectorGRPCAddress is set, and its HTTP API
+// otherwise.
+func newAgentClient() (gskp.KeyClient, error) {
+	address := viper.GetString("agentCollectorGRPCAddress")
+	if address == "" {
+		return gskp.NewClient(viper.GetString("collectorBaseURL"), viper.GetInt64("agentLongpollTimeoutSeconds"))
+	}
+
+	for _, cv := range []string{"agentGRPCCertFile", "agentGRPCKeyFile", "agentGRPCCAFile"} {
+		if viper.GetString(cv) == "" {
+			return nil, fmt.Errorf("please specify a config value for %s", cv)
+		}
+	}
+
+	tlsConfig, err := gskp.NewGRPCClientTLSConfig(
+		viper.GetString("agentGRPCCertFile"),
+		viper.GetString("agentGRPCKeyFile"),
+		viper.GetString("agentGRPCCAFile"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return gskp.NewGRPCClient(address, tlsConfig)
+}
+
+// agentTeams returns the list of teams the agent should manage keys for. The
+// agentGithubTeams value is a comma separated list, while agentGithubTeam is
+// still accepted for a single team.
+func agentTeams() []string {
+	teams := []string{}
+	seen := map[string]bool{}
+
+	for _, t := range append(strings.Split(viper.GetString("agentGithubTeams"), ","), viper.GetString("agentGithubTeam")) {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+
+		seen[t] = true
+		teams = append(teams, t)
+	}
+
+	return teams
+}
+
+// getTeamKeys gets the current keys of a team. A team that does not exist on
+// the collector has no keys.
+func getTeamKeys(client gskp.KeyClient, team string) ([]gskp.UserInfo, error) {
+	data, err := client.GetKeys(team)
+	if err == gskp.ErrClientTeamNotFound {
+		simplelog.Infof("team '%s' was not found on the collector", team)
+		return []gskp.UserInfo{}, nil
+	}
+
+	return data, err
+}
+
+// bootstrapTeam retries to get the initial keys of a team every minute, until
+// it succeeds. The keys are then sent as an update and the team is watched for
+// changes.
+func bootstrapTeam(client gskp.KeyClient, team string, updates chan<- teamKeys, watch func(string)) {
+	for {
+		time.Sleep(time.Minute)
+
+		data, err := getTeamKeys(client, team)
+		if err != nil {
+			simplelog.Errorf("error while trying to bootstrap with initial keys for team '%s', will try again in a minute: %v", team, err)
+			continue
+		}
+
+		updates <- teamKeys{team: team, data: data}
+		watch(team)
+		return
+	}
+}
+
+func pollTeam(client *gskp.Client, team string, updates chan<- teamKeys) {
+	for {
+		simplelog.Debugf("starting longpoll request for team '%s'", team)
+		data, err := client.PollForKeys(team)
+		if err == gskp.ErrClientPollTimeout {
+			simplelog.Debugf("longpoll timeout for team '%s', will re-start", team)
+			continue
+		} else if err == gskp.ErrClientTeamNotFound {
+			simplelog.Infof("team '%s' was not found, removing its keys and polling again in 15 seconds", team)
+			updates <- teamKeys{team: team, data: []gskp.UserInfo{}}
+			time.Sleep(15 * time.Second)
+		} else if err != nil {
+			simplelog.Errorf("error while polling for key changes for team '%s', ignoring and retrying in 15 seconds: %v", team, err)
+			time.Sleep(15 * time.Second)
+		} else {
+			updates <- teamKeys{team: team, data: data}
+		}
+	}
+}
+
+func streamTeam(client gskp.KeyClient, team string, updates chan<- teamKeys) {
+	client.WatchKeys(team, nil, func(data []gskp.UserInfo) {
+		updates <- teamKeys{team: team, data: data}
+	})
+}
+
+func mergeTeamData(teams []string, teamData map[string][]gskp.UserInfo) []gskp.UserInfo {
+	sets := [][]gskp.UserInfo{}
+	for _, team := range teams {
+		sets = append(sets, teamData[team])
+	}
+
+	return gskp.MergeUserInfo(sets...)
+}
+
+// logKeyDiff logs the users and keys that were granted or revoked access by
+// an update of the authorized_keys file.
+func logKeyDiff(diff gskp.KeyDiff) {
+	for _, user := range diff.AddedUsers {
+		simplelog.Infof("granted access to user '%s'", userName(user.Login, user.Source))
+	}
+
+	for _, key := range diff.AddedKeys {
+		simplelog.Infof("granted access to %s key %s of user '%s'", key.Type, key.Fingerprint, userName(key.Login, key.Source))
+	}
+
+	for _, user := range diff.RemovedUsers {
+		simplelog.Infof("revoked access of user '%s'", userName(user.Login, user.Source))
+	}
+
+	for _, key := range diff.RemovedKeys {
+		simplelog.Infof("revoked access of %s key %s of user '%s'", key.Type, key.Fingerprint, userName(key.Login, key.Source))
+	}
+}
+
+// userName returns the login of a user, followed by their source unless they
+// are a GitHub user (eg. "alice (ldap)").
+func userName(login string, source string) string {
+	if source == "" {
+		return login
+	}
+
+	return fmt.Sprintf("%s (%s)", login, source)
+}
+
+// updateAuthorizedKeys writes the keys to the authorized_keys file. It returns
+// an error if the file could not be updated, but not if it was already up to
+// date.
+func updateAuthorizedKeys(data []gskp.UserInfo) error {
 	simplelog.Infof("updating %s", viper.GetString("authorizedKeysPath"))
 
 	snippet, err := gskp.AuthorizedKeys.GenerateSnippet(data)
 	if err != nil {
 		simplelog.Errorf("could not generate authorized_keys snippet: %v", err)
+		return err
 	}
 
 	err = gskp.AuthorizedKeys.Update(viper.GetString("authorizedKeysPath"), snippet)
@@ -84,5 +277,8 @@ func updateAuthorizedKeys(data []gskp.UserInfo) {
 		simplelog.Infof("the authorized_keys snippet makes no changes to the file, ignoring")
 	} else if err != nil {
 		simplelog.Errorf("error occurred while trying to update '%s': %v", viper.GetString("authorizedKeysPath"), err)
+		return err
 	}
+
+	return nil
 }
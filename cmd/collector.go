@@ -1,14 +1,20 @@
 package cmd
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/utilitywarehouse/github-sshkey-provider/gskp"
 	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
 )
 
 func init() {
@@ -22,14 +28,74 @@ var collectorCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		simplelog.Infof("starting up")
 
-		for _, cv := range []string{"organizationName", "githubAccessToken", "collectorCacheTTL", "collectorHTTPTimeout", "collectorHTTPAddress"} {
+		for _, cv := range []string{"collectorCacheTTL", "collectorHTTPTimeout", "collectorHTTPAddress"} {
 			if viper.GetString(cv) == "" {
 				simplelog.Errorf("please specify a config value for %s", cv)
 				os.Exit(-1)
 			}
 		}
 
-		cache := gskp.NewKeyCache(viper.GetString("organizationName"), viper.GetString("githubAccessToken"), time.Duration(viper.GetInt("collectorCacheTTL"))*time.Second)
+		sources := []gskp.KeySource{}
+		for _, name := range strings.Split(viper.GetString("collectorKeySource"), ",") {
+			source, err := newKeySource(strings.TrimSpace(name))
+			if err != nil {
+				simplelog.Errorf("failed to create key source, exiting: %v", err)
+				os.Exit(-1)
+			}
+			sources = append(sources, source)
+		}
+
+		var source gskp.KeySource = gskp.NewMultiKeySource(sources...)
+		if len(sources) == 1 {
+			source = sources[0]
+		}
+
+		cache := gskp.NewKeyCache(source, time.Duration(viper.GetInt("collectorCacheTTL"))*time.Second)
+
+		if viper.GetInt("collectorCacheMaxStaleness") < 0 {
+			simplelog.Errorf("collectorCacheMaxStaleness cannot be negative, exiting")
+			os.Exit(-1)
+		}
+		cache.MaxStaleness = time.Duration(viper.GetInt("collectorCacheMaxStaleness")) * time.Second
+
+		if viper.GetInt("collectorCacheHistoryLength") < 1 {
+			simplelog.Errorf("collectorCacheHistoryLength must be at least 1, exiting")
+			os.Exit(-1)
+		}
+		cache.HistoryLength = viper.GetInt("collectorCacheHistoryLength")
+
+		if cacheFile := viper.GetString("collectorCacheFile"); cacheFile != "" {
+			if err := cache.SetCacheFile(cacheFile); err != nil {
+				simplelog.Errorf("could not load the key cache from '%s', starting with an empty cache: %v", cacheFile, err)
+			}
+		}
+
+		if viper.IsSet("collectorKeyPolicy") {
+			cache.KeyPolicy = &gskp.KeyPolicy{}
+			if err := viper.UnmarshalKey("collectorKeyPolicy", cache.KeyPolicy); err != nil {
+				simplelog.Errorf("could not read collectorKeyPolicy, exiting: %v", err)
+				os.Exit(-1)
+			}
+		}
+
+		if err := viper.UnmarshalKey("collectorTeamKeyPolicies", &cache.TeamKeyPolicies); err != nil {
+			simplelog.Errorf("could not read collectorTeamKeyPolicies, exiting: %v", err)
+			os.Exit(-1)
+		}
+
+		for team, policy := range cache.TeamKeyPolicies {
+			if err := policy.Validate(); err != nil {
+				simplelog.Errorf("invalid key policy for team '%s', exiting: %v", team, err)
+				os.Exit(-1)
+			}
+		}
+
+		if cache.KeyPolicy != nil {
+			if err := cache.KeyPolicy.Validate(); err != nil {
+				simplelog.Errorf("invalid collectorKeyPolicy, exiting: %v", err)
+				os.Exit(-1)
+			}
+		}
 
 		server, err := gskp.NewServer(cache)
 		if err != nil {
@@ -37,6 +103,8 @@ var collectorCmd = &cobra.Command{
 			os.Exit(-1)
 		}
 
+		grpcServer := newGRPCServer(server)
+
 		shutdownComplete := make(chan bool, 1)
 
 		// handle interrupt
@@ -46,6 +114,10 @@ var collectorCmd = &cobra.Command{
 			<-sigChannel
 			simplelog.Infof("received interrupt: shutdown started, waiting for server to stop")
 			server.Stop(time.Duration(viper.GetInt("collectorHTTPTimeout")) * time.Second)
+			if grpcServer != nil {
+				grpcServer.GracefulStop()
+				simplelog.Infof("gRPC server shutdown complete")
+			}
 			shutdownComplete <- true
 		}()
 
@@ -58,3 +130,199 @@ var collectorCmd = &cobra.Command{
 		simplelog.Infof("shutdown complete, exiting now")
 	},
 }
+
+// newGRPCServer starts serving the gRPC API of the server in the background,
+// if collectorGRPCAddress is set. Clients have to present a certificate signed
+// by the CA in collectorGRPCClientCAFile.
+func newGRPCServer(server *gskp.Server) *grpc.Server {
+	address := viper.GetString("collectorGRPCAddress")
+	if address == "" {
+		return nil
+	}
+
+	for _, cv := range []string{"collectorGRPCCertFile", "collectorGRPCKeyFile", "collectorGRPCClientCAFile"} {
+		if viper.GetString(cv) == "" {
+			simplelog.Errorf("please specify a config value for %s", cv)
+			os.Exit(-1)
+		}
+	}
+
+	tlsConfig, err := gskp.NewGRPCServerTLSConfig(
+		viper.GetString("collectorGRPCCertFile"),
+		viper.GetString("collectorGRPCKeyFile"),
+		viper.GetString("collectorGRPCClientCAFile"),
+	)
+	if err != nil {
+		simplelog.Errorf("could not load the gRPC server certificates, exiting: %v", err)
+		os.Exit(-1)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		simplelog.Errorf("failed to start gRPC server, exiting: %v", err)
+		os.Exit(-1)
+	}
+
+	grpcServer := server.GRPCServer(tlsConfig)
+	go func() {
+		simplelog.Infof("gRPC server listening on %s", address)
+		if err := grpcServer.Serve(listener); err != nil {
+			simplelog.Errorf("gRPC server stopped: %v", err)
+		}
+	}()
+
+	return grpcServer
+}
+
+// newKeySource creates the KeySource with the provided name, based on the
+// configuration.
+func newKeySource(name string) (gskp.KeySource, error) {
+	switch name {
+	case "github":
+		if viper.GetString("organizationName") == "" {
+			return nil, fmt.Errorf("please specify a config value for organizationName")
+		}
+
+		collector, err := newKeyCollector()
+		if err != nil {
+			return nil, err
+		}
+
+		if reserve := viper.GetFloat64("githubRateLimitReserve"); reserve < 0 || reserve >= 100 {
+			return nil, fmt.Errorf("githubRateLimitReserve must be a percentage between 0 and 100")
+		}
+
+		if viper.GetInt("githubRateLimitMaxWait") < 0 {
+			return nil, fmt.Errorf("githubRateLimitMaxWait cannot be negative")
+		}
+
+		collector.SetRateLimitPolicy(
+			viper.GetFloat64("githubRateLimitReserve")/100,
+			time.Duration(viper.GetInt("githubRateLimitMaxWait"))*time.Second,
+		)
+
+		if viper.GetInt("collectorProfileCacheTTL") < 1 {
+			return nil, fmt.Errorf("collectorProfileCacheTTL must be a positive number of seconds")
+		}
+
+		if viper.GetInt("collectorFetchConcurrency") < 1 {
+			return nil, fmt.Errorf("collectorFetchConcurrency must be at least 1")
+		}
+
+		if viper.GetInt("collectorMemberFetchTimeout") < 0 {
+			return nil, fmt.Errorf("collectorMemberFetchTimeout cannot be negative")
+		}
+
+		collector.SetMemberFetchConcurrency(
+			viper.GetInt("collectorFetchConcurrency"),
+			time.Duration(viper.GetInt("collectorMemberFetchTimeout"))*time.Second,
+		)
+		collector.SetProfileCacheTTL(time.Duration(viper.GetInt("collectorProfileCacheTTL")) * time.Second)
+
+		source := gskp.NewGithubKeySource(collector, viper.GetString("organizationName"), time.Duration(viper.GetInt("collectorCacheTTL"))*time.Second)
+		source.IncludeChildTeams = viper.GetBool("collectorIncludeChildTeams")
+
+		switch viper.GetString("collectorGithubAPI") {
+		case "rest":
+		case "graphql":
+			source.UseGraphQL = true
+		default:
+			return nil, fmt.Errorf("collectorGithubAPI must be either rest or graphql")
+		}
+
+		return source, nil
+	case "file":
+		if viper.GetString("collectorKeyFile") == "" {
+			return nil, fmt.Errorf("please specify a config value for collectorKeyFile")
+		}
+
+		return gskp.NewFileKeySource(viper.GetString("collectorKeyFile"))
+	case "gitlab":
+		for _, cv := range []string{"gitlabBaseURL", "gitlabAccessToken"} {
+			if viper.GetString(cv) == "" {
+				return nil, fmt.Errorf("please specify a config value for %s", cv)
+			}
+		}
+
+		return gskp.NewGitlabKeySource(viper.GetString("gitlabBaseURL"), viper.GetString("gitlabAccessToken"))
+	case "ldap":
+		for _, cv := range []string{"ldapAddress", "ldapSearchBase"} {
+			if viper.GetString(cv) == "" {
+				return nil, fmt.Errorf("please specify a config value for %s", cv)
+			}
+		}
+
+		return gskp.NewLdapKeySource(gskp.LdapConfig{
+			Address:      viper.GetString("ldapAddress"),
+			UseTLS:       viper.GetBool("ldapUseTLS"),
+			StartTLS:     viper.GetBool("ldapStartTLS"),
+			BindDN:       viper.GetString("ldapBindDN"),
+			BindPassword: viper.GetString("ldapBindPassword"),
+			SearchBase:   viper.GetString("ldapSearchBase"),
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unknown key source '%s'", name)
+}
+
+// newKeyCollector creates a KeyCollector that authenticates either as a GitHub
+// App, if githubAppID is set, or with the githubAccessToken. The GitHub
+// endpoints can be configured to talk to GitHub Enterprise Server.
+func newKeyCollector() (*gskp.KeyCollector, error) {
+	endpoints := gskp.GithubEndpoints{
+		BaseURL:   viper.GetString("githubBaseURL"),
+		UploadURL: viper.GetString("githubUploadURL"),
+		KeysURL:   viper.GetString("githubKeysURL"),
+	}
+
+	if viper.GetString("githubCABundle") != "" {
+		caBundle, err := ioutil.ReadFile(viper.GetString("githubCABundle"))
+		if err != nil {
+			return nil, err
+		}
+		endpoints.CABundle = caBundle
+	}
+
+	if viper.GetInt("githubAppID") == 0 {
+		if viper.GetString("githubAccessToken") == "" {
+			return nil, fmt.Errorf("please specify a config value for githubAccessToken or githubAppID")
+		}
+
+		return gskp.NewEnterpriseKeyCollector(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: viper.GetString("githubAccessToken")}), endpoints)
+	}
+
+	if viper.GetInt("githubAppInstallationID") == 0 {
+		return nil, fmt.Errorf("please specify a config value for githubAppInstallationID")
+	}
+
+	privateKey := []byte(viper.GetString("githubAppPrivateKey"))
+	if len(privateKey) == 0 {
+		if viper.GetString("githubAppPrivateKeyFile") == "" {
+			return nil, fmt.Errorf("please specify a config value for githubAppPrivateKey or githubAppPrivateKeyFile")
+		}
+
+		var err error
+		privateKey, err = ioutil.ReadFile(viper.GetString("githubAppPrivateKeyFile"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient, err := gskp.NewGithubHTTPClient(endpoints.CABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenSource, err := gskp.NewGithubAppTokenSource(gskp.GithubAppConfig{
+		AppID:          viper.GetInt("githubAppID"),
+		InstallationID: viper.GetInt("githubAppInstallationID"),
+		PrivateKey:     privateKey,
+		APIURL:         endpoints.BaseURL,
+		HTTPClient:     httpClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return gskp.NewEnterpriseKeyCollector(tokenSource, endpoints)
+}
@@ -67,8 +67,23 @@ func setConfigDefaults() {
 	viper.SetDefault("collectorHTTPTimeout", 10)
 	viper.SetDefault("collectorHTTPAddress", ":3000")
 	viper.SetDefault("collectorCacheTTL", 300)
+	viper.SetDefault("collectorCacheMaxStaleness", 3600)
+	viper.SetDefault("collectorCacheHistoryLength", 20)
+	viper.SetDefault("collectorProfileCacheTTL", 86400)
+	viper.SetDefault("collectorFetchConcurrency", 10)
+	viper.SetDefault("collectorMemberFetchTimeout", 30)
+	viper.SetDefault("collectorIncludeChildTeams", false)
+	viper.SetDefault("collectorGithubAPI", "rest")
+	viper.SetDefault("collectorKeySource", "github")
+	viper.SetDefault("collectorGRPCAddress", "")
+	viper.SetDefault("ldapUseTLS", false)
+	viper.SetDefault("ldapStartTLS", true)
+	viper.SetDefault("githubRateLimitReserve", 10)
+	viper.SetDefault("githubRateLimitMaxWait", 900)
 
 	viper.SetDefault("collectorBaseURL", "http://localhost:3000/")
 	viper.SetDefault("agentLongpollTimeoutSeconds", 0)
+	viper.SetDefault("agentStreamUpdates", false)
+	viper.SetDefault("agentCollectorGRPCAddress", "")
 	viper.SetDefault("authorizedKeysPath", "authorized_keys")
 }
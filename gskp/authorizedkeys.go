@@ -20,7 +20,9 @@ const (
 {{- else -}}
     unknown name
 {{- end }})
-{{ $user.Keys }}
+{{ range $key := $user.Keys -}}
+{{ $key }}
+{{ end -}}
 {{ end -}}`
 )
 
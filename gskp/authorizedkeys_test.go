@@ -16,22 +16,23 @@ func TestAuthorizedKeys_GenerateAuthorizedKeysFile(t *testing.T) {
 			Login: "user00",
 			ID:    999998,
 			Name:  "User Zero",
-			Keys:  "ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string_for_user00",
+			Keys:  []SSHKey{testSSHKey},
 		},
 		UserInfo{
 			Login: "user01",
 			ID:    999999,
 			Name:  "User One",
-			Keys:  "ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string_for_user01",
+			Keys:  []SSHKey{testSSHKeyRSA, testSSHKeySRE},
 		},
 	}
 
 	akExpected := `# BEGIN: github_sshkey_provider
 
 # SSH keys for user00 (User Zero)
-ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string_for_user00
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/
 # SSH keys for user01 (User One)
-ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string_for_user01
+ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC/oF7V47yexBD7Gih49PuZS1hg08p1WNjkZIvGOK4/C1kSanB3Zm96VBwhNxgDEOH5chzRLaORcziVu96W+9Ias9A8XP4pw4Z2bkz1tIkbrnSRRwzcQP0Bsf/xWfsQrZpEMFyTabK1scwRxjBt29UBIL5Kpoxei4iyDjRVVEOptecwfGrKVIlBkym5rkT2fTaQu3JQnFMVcdzoobrD/XbqBxN8Uc0mobwnDYUdMKr0jIMgvzKU0RHgpvE6qOQD7kv9NuENIHvYCGKniFNaHgpz3xSeFMrUWoSJSgM66ALsXqDj90MCrMOM6o/ZYz4Mao1DR2XLeoHUX2EW2YBSkVVl user@desktop
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPLFs4I0pzZk/KhcwSyPFGRMpI17C4d7u1zV2y7j5o/A
 
 # END: github_sshkey_provider`
 
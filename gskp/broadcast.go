@@ -0,0 +1,87 @@
+package gskp
+
+import (
+	"sort"
+	"sync"
+)
+
+// teamBroadcaster wakes up everyone waiting for a change to the keys of a
+// team. Each team has a channel that is closed on a change and replaced by a
+// new one for the next change, so waking up any number of waiters takes a
+// single close, and a waiter that subscribed before a change never misses
+// it, whether or not it was already waiting on the channel.
+type teamBroadcaster struct {
+	teams map[string]*teamBroadcast
+	mutex *sync.Mutex
+}
+
+// teamBroadcast is a single generation of the channel of a team, along with
+// the number of subscribers still waiting on it.
+type teamBroadcast struct {
+	changed     chan struct{}
+	subscribers int
+}
+
+func newTeamBroadcaster() *teamBroadcaster {
+	return &teamBroadcaster{
+		teams: map[string]*teamBroadcast{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Subscribe returns a channel that is closed on the next change of the team,
+// and a function that has to be called once the caller stops waiting.
+func (b *teamBroadcaster) Subscribe(teamName string) (<-chan struct{}, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	broadcast, exists := b.teams[teamName]
+	if !exists {
+		broadcast = &teamBroadcast{changed: make(chan struct{})}
+		b.teams[teamName] = broadcast
+	}
+	broadcast.subscribers++
+
+	unsubscribe := func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		broadcast.subscribers--
+		if broadcast.subscribers == 0 && b.teams[teamName] == broadcast {
+			delete(b.teams, teamName)
+		}
+	}
+
+	return broadcast.changed, unsubscribe
+}
+
+// Notify wakes up everyone subscribed to the team and returns how many
+// subscribers there were.
+func (b *teamBroadcaster) Notify(teamName string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	broadcast, exists := b.teams[teamName]
+	if !exists {
+		return 0
+	}
+
+	close(broadcast.changed)
+	delete(b.teams, teamName)
+
+	return broadcast.subscribers
+}
+
+// Teams returns the teams that have subscribers, in alphabetical order.
+func (b *teamBroadcaster) Teams() []string {
+	b.mutex.Lock()
+	teams := make([]string, 0, len(b.teams))
+	for team := range b.teams {
+		teams = append(teams, team)
+	}
+	b.mutex.Unlock()
+
+	sort.Strings(teams)
+
+	return teams
+}
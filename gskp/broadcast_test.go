@@ -0,0 +1,179 @@
+package gskp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+// testBenchmarkClients is the number of concurrent long-poll clients used in
+// the benchmarks
+const testBenchmarkClients = 10000
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestTeamBroadcaster(t *testing.T) {
+	b := newTeamBroadcaster()
+
+	changedA1, unsubscribeA1 := b.Subscribe("a")
+	changedA2, unsubscribeA2 := b.Subscribe("a")
+	changedB, unsubscribeB := b.Subscribe("b")
+
+	if teams := b.Teams(); !reflect.DeepEqual(teams, []string{"a", "b"}) {
+		t.Errorf("teamBroadcaster.Teams returned unexpected teams: %v", teams)
+	}
+
+	// nobody is waiting on the channels yet, but the change must not be lost
+	if notified := b.Notify("a"); notified != 2 {
+		t.Errorf("teamBroadcaster.Notify returned %d subscribers, expected 2", notified)
+	}
+
+	if !isClosed(changedA1) || !isClosed(changedA2) {
+		t.Error("teamBroadcaster.Notify did not wake up the subscribers of the team")
+	}
+
+	if isClosed(changedB) {
+		t.Error("teamBroadcaster.Notify woke up the subscribers of another team")
+	}
+
+	changedA3, unsubscribeA3 := b.Subscribe("a")
+	if isClosed(changedA3) {
+		t.Error("teamBroadcaster.Subscribe returned the channel of a previous change")
+	}
+
+	unsubscribeA1()
+	unsubscribeA2()
+	if teams := b.Teams(); !reflect.DeepEqual(teams, []string{"a", "b"}) {
+		t.Errorf("unsubscribing from a previous change removed the current one: %v", teams)
+	}
+
+	unsubscribeA3()
+	unsubscribeB()
+	if teams := b.Teams(); len(teams) != 0 {
+		t.Errorf("teamBroadcaster.Teams returned teams without subscribers: %v", teams)
+	}
+
+	if notified := b.Notify("a"); notified != 0 {
+		t.Errorf("teamBroadcaster.Notify returned %d subscribers for a team without any", notified)
+	}
+}
+
+// waitForSubscribers blocks until the team has the number of subscribers.
+func waitForSubscribers(b *teamBroadcaster, teamName string, subscribers int) {
+	for {
+		b.mutex.Lock()
+		broadcast, exists := b.teams[teamName]
+		done := exists && broadcast.subscribers == subscribers
+		b.mutex.Unlock()
+
+		if done {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkTeamBroadcaster_Notify measures how long it takes to wake up all
+// the subscribers of a team.
+func BenchmarkTeamBroadcaster_Notify(b *testing.B) {
+	broadcaster := newTeamBroadcaster()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		wg := sync.WaitGroup{}
+		for c := 0; c < testBenchmarkClients; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				changed, unsubscribe := broadcaster.Subscribe("team")
+				defer unsubscribe()
+				<-changed
+			}()
+		}
+
+		waitForSubscribers(broadcaster, "team", testBenchmarkClients)
+		b.StartTimer()
+
+		broadcaster.Notify("team")
+		wg.Wait()
+	}
+}
+
+// BenchmarkServer_keysLongpoll measures how long it takes for a change of the
+// keys to reach all the clients that are long-polling for the team.
+func BenchmarkServer_keysLongpoll(b *testing.B) {
+	debugEnabled := simplelog.DebugEnabled
+	simplelog.DebugEnabled = false
+	defer func() { simplelog.DebugEnabled = debugEnabled }()
+
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	s, _ := NewServer(cache)
+	if _, err := cache.Get("deploy"); err != nil {
+		b.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	// the first update should not wake up the clients of the first iteration
+	<-cache.Updates
+	cache.UpdatedTeams()
+
+	go s.updateManager()
+	defer func() { s.updateManagerStop <- true }()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		wg := sync.WaitGroup{}
+		for c := 0; c < testBenchmarkClients; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				w := httptest.NewRecorder()
+				s.keysHandler(w, httptest.NewRequest(http.MethodGet, "/keys?team=deploy&timeout=600", nil))
+				if w.Code != http.StatusOK || w.Header().Get(serverVersionHeader) == "" {
+					b.Errorf("unexpected response to a long-poll request: %d %s", w.Code, w.Body.String())
+				}
+			}()
+		}
+
+		waitForSubscribers(s.updateManagerBroadcaster, "deploy", testBenchmarkClients)
+
+		source.mutex.Lock()
+		source.groups["deploy"] = []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: fmt.Sprintf("Deploy Bot %d", i), Keys: []SSHKey{testSSHKey}}}
+		source.mutex.Unlock()
+		cache.mutex.Lock()
+		entry := cache.cache["deploy"]
+		entry.UpdatedAt = time.Time{}
+		cache.cache["deploy"] = entry
+		cache.mutex.Unlock()
+
+		b.StartTimer()
+
+		if err := cache.update("deploy"); err != nil {
+			b.Fatalf("KeyCache.update returned an error: %v", err)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,106 @@
+package gskp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheFile persists the entries of a KeyCache to a JSON file, so that they
+// can be served after a restart. A nil cacheFile persists nothing.
+type cacheFile struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+type cacheFileContents struct {
+	Teams map[string]cacheFileEntry `json:"teams"`
+}
+
+// cacheFileEntry is the stored form of a cacheEntry. Data is the JSON that is
+// served to clients, which the users are decoded from when loading.
+type cacheFileEntry struct {
+	Data      json.RawMessage `json:"data"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Version   uint64          `json:"version"`
+}
+
+func newCacheFile(path string) *cacheFile {
+	return &cacheFile{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// load returns the entries stored in the file. A missing file holds no
+// entries. Entries that cannot be decoded are skipped.
+func (f *cacheFile) load() (map[string]cacheEntry, error) {
+	entries := map[string]cacheEntry{}
+
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	contents := cacheFileContents{}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, err
+	}
+
+	for team, stored := range contents.Teams {
+		keys := map[string][]UserInfo{}
+		if err := json.Unmarshal(stored.Data, &keys); err != nil {
+			continue
+		}
+
+		entries[team] = cacheEntry{
+			Users:     keys["keys"],
+			JSON:      []byte(stored.Data),
+			UpdatedAt: stored.UpdatedAt,
+			Version:   stored.Version,
+			Restored:  true,
+		}
+	}
+
+	return entries, nil
+}
+
+// save replaces the contents of the file with the entries. The file is
+// written under a temporary name first, so it is never left half written.
+func (f *cacheFile) save(entries map[string]cacheEntry) error {
+	contents := cacheFileContents{Teams: map[string]cacheFileEntry{}}
+	for team, entry := range entries {
+		contents.Teams[team] = cacheFileEntry{
+			Data:      json.RawMessage(entry.JSON),
+			UpdatedAt: entry.UpdatedAt,
+			Version:   entry.Version,
+		}
+	}
+
+	data, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
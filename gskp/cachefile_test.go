@@ -0,0 +1,119 @@
+package gskp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyCache_SetCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gskp")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	if err := cache.SetCacheFile(path); err != nil {
+		t.Fatalf("KeyCache.SetCacheFile returned an error for a missing file: %v", err)
+	}
+
+	dataExpected, err := cache.Get("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	version, _ := cache.Version("deploy")
+
+	// a restarted collector should serve the stored keys without waiting for
+	// the source, even though they are not older than the TTL
+	source.blocked = map[string]chan struct{}{"deploy": make(chan struct{})}
+
+	restarted := NewKeyCache(source, time.Hour)
+	if err := restarted.SetCacheFile(path); err != nil {
+		t.Fatalf("KeyCache.SetCacheFile returned an error: %v", err)
+	}
+
+	data, err := restarted.Get("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	if !bytes.Equal(data, dataExpected) {
+		t.Errorf("KeyCache.Get returned unexpected value for stored keys: %s", data)
+	}
+
+	if entry, _ := restarted.entry("deploy"); !entry.Restored || entry.Version != version || len(entry.Users) != 1 {
+		t.Errorf("KeyCache.SetCacheFile loaded an unexpected entry: %+v", entry)
+	}
+
+	stored, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read the cache file: %v", err)
+	}
+
+	close(source.blocked["deploy"])
+	if err := restarted.update("deploy"); err != nil {
+		t.Fatalf("KeyCache.update returned an error: %v", err)
+	}
+
+	// the keys have not changed, so the file is not written again
+	if current, _ := ioutil.ReadFile(path); !bytes.Equal(current, stored) {
+		t.Errorf("KeyCache.update rewrote the cache file although the keys have not changed")
+	}
+
+	if entry, _ := restarted.entry("deploy"); entry.Restored || entry.Version != version {
+		t.Errorf("KeyCache.update did not refresh the stored entry: %+v", entry)
+	}
+
+	if source.calls != 2 {
+		t.Errorf("KeyCache should have updated the stored keys once, but the source was called %d times", source.calls)
+	}
+}
+
+func TestKeyCache_SetCacheFile_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gskp")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("could not write the cache file: %v", err)
+	}
+
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	if err := cache.SetCacheFile(path); err == nil {
+		t.Fatal("KeyCache.SetCacheFile should have returned an error for an invalid file")
+	}
+
+	if _, err := cache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	entries, err := newCacheFile(path).load()
+	if err != nil {
+		t.Fatalf("the cache file was not replaced after an update: %v", err)
+	}
+
+	if _, exists := entries["deploy"]; !exists {
+		t.Errorf("the cache file does not contain the updated team: %v", entries)
+	}
+}
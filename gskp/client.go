@@ -1,14 +1,36 @@
 package gskp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// defaultClientStreamIdleTimeout is how long a stream can go without
+	// receiving anything, heartbeats included, before it is reconnected.
+	defaultClientStreamIdleTimeout = 4 * defaultStreamHeartbeatInterval
+
+	// defaultClientStreamReconnectDelay is how long the client waits before
+	// reconnecting an interrupted stream.
+	defaultClientStreamReconnectDelay = 15 * time.Second
+
+	// clientStreamMaxEventSize is the largest event the client accepts on a
+	// stream, which has to fit the keys of a whole team.
+	clientStreamMaxEventSize = 16 * 1024 * 1024
 )
 
 var (
@@ -24,13 +46,34 @@ var (
 	// ErrClientEmptyCollectorBaseURL is returned if trying to create a new
 	// Client with an empty base URL.
 	ErrClientEmptyCollectorBaseURL = errors.New("collectorBaseURL cannot be empty")
+	// ErrClientStreamInterrupted is returned when a stream of key updates ends,
+	// or stops receiving heartbeats.
+	ErrClientStreamInterrupted = errors.New("stream was interrupted")
+	// ErrClientTeamNotFound is returned when the collector does not know the
+	// team, or has removed it.
+	ErrClientTeamNotFound = errors.New("team not found")
 )
 
-// Client is used by the agent to make requests to the collector service.
+// KeyClient gets the keys of teams from the collector. It is implemented by
+// Client over HTTP and by GRPCClient over gRPC.
+type KeyClient interface {
+	GetKeys(teamName string) ([]UserInfo, error)
+	WatchKeys(teamName string, stop <-chan struct{}, handler func([]UserInfo))
+	ListTeams() ([]string, error)
+}
+
+// Client is used by the agent to make requests to the collector service. It
+// remembers the version of the keys it last received for each team, so that
+// PollForKeys returns straight away if they have changed in the meantime.
 type Client struct {
 	collectorBaseURL string
 	timeoutSeconds   int64
 	client           *http.Client
+	versions         map[string]string
+	mutex            *sync.Mutex
+
+	streamIdleTimeout    time.Duration
+	streamReconnectDelay time.Duration
 }
 
 // NewClient creates and returns a new Client with the provided configuration.
@@ -43,6 +86,11 @@ func NewClient(collectorBaseURL string, timeoutSeconds int64) (*Client, error) {
 		collectorBaseURL: collectorBaseURL,
 		timeoutSeconds:   timeoutSeconds,
 		client:           &http.Client{},
+		versions:         map[string]string{},
+		mutex:            &sync.Mutex{},
+
+		streamIdleTimeout:    defaultClientStreamIdleTimeout,
+		streamReconnectDelay: defaultClientStreamReconnectDelay,
 	}, nil
 }
 
@@ -51,11 +99,208 @@ func (c *Client) GetKeys(teamName string) ([]UserInfo, error) {
 	return c.requestKeys(teamName, false)
 }
 
+// ListTeams returns the teams the collector has keys for.
+func (c *Client) ListTeams() ([]string, error) {
+	u, err := url.Parse(c.collectorBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "teams")
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range clientHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrClientUnexpected
+	}
+
+	data := struct {
+		Teams []string `json:"teams"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return data.Teams, nil
+}
+
 // PollForKeys starts a longpoll request to watch for updates on the SSH keys.
+// If the keys have changed since they were last received, it returns
+// immediately.
 func (c *Client) PollForKeys(teamName string) ([]UserInfo, error) {
 	return c.requestKeys(teamName, true)
 }
 
+// WatchKeys streams updates of the SSH keys from the collector over a single
+// connection, calling handler with the full list of keys every time they
+// change. Unless the client already has the current version of the keys, the
+// handler is first called with them straight away. Interrupted streams are
+// reconnected with the last version that was received. If the team does not
+// exist or is removed, handler is called with no keys and the stream is
+// retried, in case the team comes back. WatchKeys only returns once stop is
+// closed.
+func (c *Client) WatchKeys(teamName string, stop <-chan struct{}, handler func([]UserInfo)) {
+	for {
+		err := c.streamKeys(teamName, stop, handler)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err == ErrClientTeamNotFound {
+			simplelog.Infof("team '%s' was not found, removed its keys and retrying in %.0f seconds", teamName, c.streamReconnectDelay.Seconds())
+		} else {
+			simplelog.Errorf("stream of key updates for team '%s' was interrupted, reconnecting in %.0f seconds: %v", teamName, c.streamReconnectDelay.Seconds(), err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.streamReconnectDelay):
+		}
+	}
+}
+
+// streamKeys reads a single stream of key updates until it is interrupted.
+func (c *Client) streamKeys(teamName string, stop <-chan struct{}, handler func([]UserInfo)) error {
+	u, err := url.Parse(c.collectorBaseURL)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, "keys", "stream")
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range clientHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	q := req.URL.Query()
+	q.Add("team", teamName)
+	if version := c.version(teamName); version != "" {
+		q.Add("version", version)
+	}
+	req.URL.RawQuery = q.Encode()
+
+	// the request is cancelled when stop is closed or the stream goes idle
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	idle := time.AfterFunc(c.streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	simplelog.Debugf("starting stream of key updates for team '%s'", teamName)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// only a collector that knows the team is gone clears its keys, a 404
+		// from anything else (eg. a proxy) keeps them
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, clientStreamMaxEventSize))
+		if err != nil || !isTeamNotFound(body) {
+			return ErrClientUnexpected
+		}
+
+		c.setVersion(teamName, "")
+		handler([]UserInfo{})
+		return ErrClientTeamNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return ErrClientUnexpected
+	}
+
+	var id, event, data string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), clientStreamMaxEventSize)
+	for scanner.Scan() {
+		idle.Reset(c.streamIdleTimeout)
+
+		line := scanner.Text()
+		if line == "" {
+			if event == "keys" {
+				keys := map[string][]UserInfo{}
+				if err := json.Unmarshal([]byte(data), &keys); err != nil {
+					return err
+				}
+
+				c.setVersion(teamName, id)
+				handler(keys["keys"])
+			} else if event == "deleted" {
+				if !isTeamNotFound([]byte(data)) {
+					return ErrClientUnexpected
+				}
+
+				c.setVersion(teamName, "")
+				handler([]UserInfo{})
+				return ErrClientTeamNotFound
+			}
+
+			id, event, data = "", "", ""
+			continue
+		}
+
+		// lines starting with a colon are comments, which are used as
+		// heartbeats
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i == 0 {
+			continue
+		} else if i > 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			if data != "" {
+				data += "\n"
+			}
+			data += value
+		}
+	}
+
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return ErrClientStreamInterrupted
+}
+
 func (c *Client) requestKeys(teamName string, pollForChanges bool) ([]UserInfo, error) {
 	u, err := url.Parse(c.collectorBaseURL)
 	if err != nil {
@@ -76,6 +321,8 @@ func (c *Client) requestKeys(teamName string, pollForChanges bool) ([]UserInfo,
 	q.Add("team", teamName)
 	if !pollForChanges {
 		q.Add("init", "true")
+	} else if version := c.version(teamName); version != "" {
+		q.Add("version", version)
 	}
 	if c.timeoutSeconds > 0 {
 		q.Add("timeout", strconv.FormatInt(c.timeoutSeconds, 10))
@@ -98,6 +345,11 @@ func (c *Client) requestKeys(teamName string, pollForChanges bool) ([]UserInfo,
 		return nil, ErrClientUnexpected
 	}
 
+	if resp.StatusCode == http.StatusNotFound && isTeamNotFound(body) {
+		c.setVersion(teamName, "")
+		return nil, ErrClientTeamNotFound
+	}
+
 	if bytes.Equal(body, serverLongpollTimeout.Marshal()) {
 		return nil, ErrClientPollTimeout
 	}
@@ -108,5 +360,27 @@ func (c *Client) requestKeys(teamName string, pollForChanges bool) ([]UserInfo,
 		return nil, err
 	}
 
+	c.setVersion(teamName, resp.Header.Get(serverVersionHeader))
+
 	return data["keys"], nil
 }
+
+// isTeamNotFound checks if a response of the collector says that the team does
+// not exist.
+func isTeamNotFound(body []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(body), serverTeamNotFound.Marshal())
+}
+
+func (c *Client) version(teamName string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.versions[teamName]
+}
+
+func (c *Client) setVersion(teamName string, version string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.versions[teamName] = version
+}
@@ -2,6 +2,8 @@ package gskp
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 	"time"
@@ -28,7 +30,7 @@ func TestClient_GetKeys(t *testing.T) {
 	defer h.Stop(time.Second)
 
 	var dataExpected []UserInfo
-	json.Unmarshal([]byte(`[{"login":"user","id":999999,"name":"User Name","keys":"ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string"}]`), &dataExpected)
+	json.Unmarshal([]byte(`[{"login":"user","id":999999,"name":"User Name","keys":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/","public_keys":[{"type":"ssh-ed25519","bits":256,"fingerprint":"SHA256:f7tjoDWr4mjTalf8ewxa3DmBV48XxT+WjHTRElWWigY","key":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/"}]}]`), &dataExpected)
 
 	data, err := testClient.GetKeys("Owners")
 	if err != nil {
@@ -49,11 +51,39 @@ func TestClient_GetKeys_error(t *testing.T) {
 	defer h.Stop(time.Second)
 
 	_, err := testClient.GetKeys("invalid")
-	if err != ErrClientUnexpected {
+	if err != ErrClientTeamNotFound {
 		t.Fatalf("Client.GetKeys returned unexpected error: %v", err)
 	}
 }
 
+func TestClient_ListTeams(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	h, _ := NewServer(cache)
+	ts := httptest.NewServer(h.mux)
+	defer ts.Close()
+
+	if _, err := cache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	client, _ := NewClient(ts.URL, 1)
+
+	teams, err := client.ListTeams()
+	if err != nil {
+		t.Fatalf("Client.ListTeams returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(teams, []string{"deploy"}) {
+		t.Errorf("Client.ListTeams returned unexpected teams: %v", teams)
+	}
+}
+
 func TestClient_PollForKeys_timeout(t *testing.T) {
 	h := startNewTestServer()
 	defer h.Stop(time.Second)
@@ -63,3 +93,227 @@ func TestClient_PollForKeys_timeout(t *testing.T) {
 		t.Fatalf("Client.GetKeys returned unexpected error, was expecting timeout: %v", err)
 	}
 }
+
+func TestClient_PollForKeys_version(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	h, _ := NewServer(cache)
+	ts := httptest.NewServer(h.mux)
+	defer ts.Close()
+
+	client, _ := NewClient(ts.URL, 1)
+
+	if _, err := client.GetKeys("deploy"); err != nil {
+		t.Fatalf("Client.GetKeys returned unexpected error: %v", err)
+	}
+
+	// the keys change while the client is not polling
+	source.groups["deploy"] = []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot v2", Keys: []SSHKey{testSSHKey}}}
+	entry := cache.cache["deploy"]
+	entry.UpdatedAt = time.Time{}
+	cache.cache["deploy"] = entry
+	if err := cache.update("deploy"); err != nil {
+		t.Fatalf("KeyCache.update returned an error: %v", err)
+	}
+
+	data, err := client.PollForKeys("deploy")
+	if err != nil {
+		t.Fatalf("Client.PollForKeys returned unexpected error for changed keys: %v", err)
+	}
+
+	if len(data) != 1 || data[0].Name != "Deploy Bot v2" {
+		t.Errorf("Client.PollForKeys returned unexpected value: %v", data)
+	}
+
+	// the client now has the latest version, so it has to wait for a change
+	if _, err := client.PollForKeys("deploy"); err != ErrClientPollTimeout {
+		t.Errorf("Client.PollForKeys returned unexpected error, was expecting timeout: %v", err)
+	}
+}
+
+func TestClient_PollForKeys_deleted(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	h, _ := NewServer(cache)
+	ts := httptest.NewServer(h.mux)
+	defer ts.Close()
+
+	go h.updateManager()
+	defer func() { h.updateManagerStop <- true }()
+
+	client, _ := NewClient(ts.URL, 5)
+
+	if _, err := client.GetKeys("deploy"); err != nil {
+		t.Fatalf("Client.GetKeys returned unexpected error: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.PollForKeys("deploy")
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	testDeleteTeam(t, cache, source, "deploy")
+
+	select {
+	case err := <-errs:
+		if err != ErrClientTeamNotFound {
+			t.Errorf("Client.PollForKeys returned unexpected error for a deleted team: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.PollForKeys did not return for a deleted team")
+	}
+}
+
+func TestClient_WatchKeys(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	h, _ := NewServer(cache)
+	h.streamHeartbeatInterval = 50 * time.Millisecond
+	ts := httptest.NewServer(h.mux)
+	defer ts.Close()
+	defer close(h.streamStop)
+
+	go h.updateManager()
+	defer func() { h.updateManagerStop <- true }()
+
+	client, _ := NewClient(ts.URL, 1)
+	client.streamReconnectDelay = 10 * time.Millisecond
+
+	updates := make(chan string, 10)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		client.WatchKeys("deploy", stop, func(data []UserInfo) {
+			updates <- data[0].Name
+		})
+		close(stopped)
+	}()
+
+	expectUpdate := func(name string) {
+		select {
+		case update := <-updates:
+			if update != name {
+				t.Errorf("Client.WatchKeys returned unexpected keys: %s, expected %s", update, name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Client.WatchKeys did not return the keys for %s", name)
+		}
+	}
+
+	expectUpdate("Deploy Bot")
+
+	testChangeKeys(t, cache, source, "deploy", "Deploy Bot v2")
+	expectUpdate("Deploy Bot v2")
+
+	// the client reconnects with the version it has, so it does not get the
+	// same keys again
+	ts.CloseClientConnections()
+	time.Sleep(200 * time.Millisecond)
+
+	testChangeKeys(t, cache, source, "deploy", "Deploy Bot v3")
+	expectUpdate("Deploy Bot v3")
+
+	select {
+	case update := <-updates:
+		t.Errorf("Client.WatchKeys returned unexpected keys after reconnecting: %s", update)
+	default:
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client.WatchKeys did not return after being stopped")
+	}
+}
+
+func TestClient_WatchKeys_deleted(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	h, _ := NewServer(cache)
+	ts := httptest.NewServer(h.mux)
+	defer ts.Close()
+	defer close(h.streamStop)
+
+	go h.updateManager()
+	defer func() { h.updateManagerStop <- true }()
+
+	client, _ := NewClient(ts.URL, 1)
+	client.streamReconnectDelay = 10 * time.Millisecond
+
+	updates := make(chan []UserInfo, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go client.WatchKeys("deploy", stop, func(data []UserInfo) {
+		// the client keeps retrying, so do not block it once the test is over
+		select {
+		case updates <- data:
+		default:
+		}
+	})
+
+	expectUpdate := func(users int) {
+		select {
+		case update := <-updates:
+			if len(update) != users {
+				t.Errorf("Client.WatchKeys returned unexpected keys: %v", update)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Client.WatchKeys did not return the keys")
+		}
+	}
+
+	expectUpdate(1)
+
+	// the keys of a deleted team are cleared, and stay cleared while the
+	// client retries
+	testDeleteTeam(t, cache, source, "deploy")
+	expectUpdate(0)
+	expectUpdate(0)
+}
+
+func TestClient_WatchKeys_notFound(t *testing.T) {
+	// a 404 that does not come from the collector, eg. from a proxy
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	client, _ := NewClient(ts.URL, 1)
+	client.setVersion("deploy", "1")
+
+	called := false
+	err := client.streamKeys("deploy", make(chan struct{}), func(data []UserInfo) {
+		called = true
+	})
+
+	if err != ErrClientUnexpected {
+		t.Errorf("Client.streamKeys returned unexpected error for an unknown 404: %v", err)
+	}
+
+	if called || client.version("deploy") != "1" {
+		t.Errorf("Client.streamKeys cleared the keys for a 404 that did not come from the collector")
+	}
+}
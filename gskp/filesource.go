@@ -0,0 +1,189 @@
+package gskp
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"gopkg.in/yaml.v2"
+)
+
+// FileKeySource is a KeySource that reads groups, users and their keys from a
+// local YAML or JSON file. It can be used for accounts that are not GitHub
+// users, like CI deploy bots or break-glass keys. The file is reloaded when
+// its modification time or size changes.
+//
+// The file is expected to look like this:
+//
+//	groups:
+//	  platform:
+//	    - login: deploy-bot
+//	      name: CI deploy bot
+//	      keys:
+//	        - ssh-ed25519 AAAA...
+//
+// Users without an id are given a stable negative ID, derived from their
+// login. The Source of the users is "file", so they are never mistaken for
+// GitHub users with the same ID.
+type FileKeySource struct {
+	path    string
+	groups  map[string][]UserInfo
+	modTime time.Time
+	size    int64
+	mutex   *sync.Mutex
+}
+
+// fileKeySourceName is the Source of the users of a FileKeySource.
+const fileKeySourceName = "file"
+
+type keyFile struct {
+	Groups map[string][]keyFileUser `yaml:"groups"`
+}
+
+type keyFileUser struct {
+	Login string   `yaml:"login"`
+	ID    int      `yaml:"id"`
+	Name  string   `yaml:"name"`
+	Keys  []string `yaml:"keys"`
+}
+
+// NewFileKeySource returns a FileKeySource for the specified file. It returns
+// an error if the file cannot be loaded.
+func NewFileKeySource(path string) (*FileKeySource, error) {
+	s := &FileKeySource{
+		path:   path,
+		groups: map[string][]UserInfo{},
+		mutex:  &sync.Mutex{},
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileKeySource) userSource() string {
+	return fileKeySourceName
+}
+
+// GetGroupMemberInfo returns the users of the specified group in the file. If
+// the file has changed since it was last read, it is reloaded first. If the
+// reload fails, the previously loaded contents are used.
+func (s *FileKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	if err := s.reload(); err != nil {
+		simplelog.Errorf("could not reload key file '%s', using previous contents: %v", s.path, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	users, exists := s.groups[groupName]
+	if !exists {
+		return nil, ErrTeamNotFound
+	}
+
+	ret := make([]UserInfo, len(users))
+	copy(ret, users)
+
+	return ret, nil
+}
+
+// reload reads the file again if it has changed since it was last read.
+func (s *FileKeySource) reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+
+	simplelog.Infof("loading keys from file '%s'", s.path)
+
+	contents, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	groups, err := parseKeyFile(contents)
+	if err != nil {
+		return err
+	}
+
+	s.groups = groups
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+
+	return nil
+}
+
+// parseKeyFile parses the contents of a key file. JSON is a subset of YAML,
+// so both formats are handled by the YAML parser. Invalid keys are logged and
+// skipped.
+func parseKeyFile(contents []byte) (map[string][]UserInfo, error) {
+	kf := keyFile{}
+	if err := yaml.Unmarshal(contents, &kf); err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]UserInfo{}
+
+	for group, users := range kf.Groups {
+		groups[group] = []UserInfo{}
+
+		for _, u := range users {
+			if u.Login == "" {
+				return nil, fmt.Errorf("user without a login in group '%s'", group)
+			}
+
+			ui := UserInfo{
+				Login:  u.Login,
+				ID:     u.ID,
+				Source: fileKeySourceName,
+				Name:   u.Name,
+				Keys:   []SSHKey{},
+			}
+
+			if ui.ID == 0 {
+				ui.ID = staticUserID(u.Login)
+			}
+
+			for _, line := range u.Keys {
+				key, err := ParseSSHKey(line)
+				if err != nil {
+					simplelog.Infof("Rejected invalid SSH key for user '%s' in group '%s': %v", u.Login, group, err)
+					continue
+				}
+
+				ui.Keys = append(ui.Keys, key)
+			}
+
+			if len(ui.Keys) == 0 {
+				simplelog.Infof("No public SSH keys for user '%s' in group '%s'", u.Login, group)
+				continue
+			}
+
+			groups[group] = append(groups[group], ui)
+		}
+	}
+
+	return groups, nil
+}
+
+// staticUserID returns a negative ID for a user that is derived from their
+// login.
+func staticUserID(login string) int {
+	h := fnv.New32a()
+	h.Write([]byte(login))
+
+	return -int(h.Sum32()&0x7fffffff) - 1
+}
@@ -0,0 +1,111 @@
+package gskp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+func writeTestKeyFile(t *testing.T, path string, contents string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Could not write the test key file: %v", err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Could not set the modification time of the test key file: %v", err)
+	}
+}
+
+func TestFileKeySource_GetGroupMemberInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gskp")
+	if err != nil {
+		t.Fatalf("Could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.yaml")
+	writeTestKeyFile(t, path, `
+groups:
+  platform:
+    - login: deploy-bot
+      name: CI deploy bot
+      keys:
+        - `+testPublicKey+`
+        - ssh-rsa not_a_valid_key
+    - login: no-keys
+  break-glass:
+    - login: emergency
+      id: 42
+      keys:
+        - `+testSSHKeyRSA.String()+`
+`, time.Now().Add(-time.Hour))
+
+	source, err := NewFileKeySource(path)
+	if err != nil {
+		t.Fatalf("NewFileKeySource returned an error: %v", err)
+	}
+
+	miExpected := []UserInfo{
+		UserInfo{Login: "deploy-bot", ID: staticUserID("deploy-bot"), Source: fileKeySourceName, Name: "CI deploy bot", Keys: []SSHKey{testSSHKey}},
+	}
+
+	mi, err := source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("FileKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("FileKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	if miExpected[0].ID >= 0 {
+		t.Errorf("staticUserID returned a non-negative ID: %d", miExpected[0].ID)
+	}
+
+	if _, err := source.GetGroupMemberInfo("unknown", nil); err != ErrTeamNotFound {
+		t.Errorf("FileKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+
+	// the file changes, in JSON format this time
+	writeTestKeyFile(t, path, `{"groups": {"platform": [{"login": "emergency", "id": 42, "keys": ["`+testSSHKeyRSA.String()+`"]}]}}`, time.Now())
+
+	miExpected = []UserInfo{
+		UserInfo{Login: "emergency", ID: 42, Source: fileKeySourceName, Keys: []SSHKey{testSSHKeyRSA}},
+	}
+
+	mi, err = source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("FileKeySource.GetGroupMemberInfo returned an error after reload: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("FileKeySource.GetGroupMemberInfo returned unexpected value after reload: %v", mi)
+	}
+
+	// a broken file should not replace the previous contents
+	writeTestKeyFile(t, path, `groups: [this is not valid`, time.Now().Add(time.Hour))
+
+	mi, err = source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("FileKeySource.GetGroupMemberInfo returned an error with a broken file: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("FileKeySource.GetGroupMemberInfo returned unexpected value with a broken file: %v", mi)
+	}
+}
+
+func TestNewFileKeySource_error(t *testing.T) {
+	if _, err := NewFileKeySource("/this/file/does/not/exist.yaml"); err == nil {
+		t.Errorf("NewFileKeySource should have returned an error for a missing file")
+	}
+}
@@ -0,0 +1,187 @@
+package gskp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultGithubAPIURL = "https://api.github.com/"
+
+	// githubAppJWTLifetime is how long the JWTs used to authenticate as the
+	// GitHub App are valid for. GitHub allows a maximum of 10 minutes.
+	githubAppJWTLifetime = 9 * time.Minute
+)
+
+var (
+	// ErrGithubAppInvalidPrivateKey is returned when the private key of a
+	// GitHub App cannot be parsed as an RSA private key.
+	ErrGithubAppInvalidPrivateKey = errors.New("GitHub App private key is not a valid PEM encoded RSA key")
+)
+
+// GithubAppConfig holds the settings that are used to authenticate as a
+// GitHub App installation. PrivateKey is the PEM encoded private key of the
+// app. APIURL defaults to the public GitHub API and HTTPClient, which can be
+// used to trust a custom CA, defaults to http.DefaultClient.
+type GithubAppConfig struct {
+	AppID          int
+	InstallationID int
+	PrivateKey     []byte
+	APIURL         string
+	HTTPClient     *http.Client
+}
+
+// githubAppTokenSource is an oauth2.TokenSource that mints a JWT for the
+// GitHub App and exchanges it for an installation access token.
+type githubAppTokenSource struct {
+	appID          int
+	installationID int
+	privateKey     *rsa.PrivateKey
+	apiURL         string
+	httpClient     *http.Client
+}
+
+// NewGithubAppTokenSource returns an oauth2.TokenSource which provides access
+// tokens for a GitHub App installation. Tokens are reused until they expire,
+// after which a new one is requested automatically.
+func NewGithubAppTokenSource(config GithubAppConfig) (oauth2.TokenSource, error) {
+	privateKey, err := parseRSAPrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	apiURL := config.APIURL
+	if apiURL == "" {
+		apiURL = defaultGithubAPIURL
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return oauth2.ReuseTokenSource(nil, &githubAppTokenSource{
+		appID:          config.AppID,
+		installationID: config.InstallationID,
+		privateKey:     privateKey,
+		apiURL:         strings.TrimSuffix(apiURL, "/") + "/",
+		httpClient:     httpClient,
+	}), nil
+}
+
+// Token requests a new installation access token from GitHub.
+func (s *githubAppTokenSource) Token() (*oauth2.Token, error) {
+	simplelog.Debugf("Requesting a new access token for GitHub App installation %d", s.installationID)
+
+	jwt, err := s.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%sapp/installations/%d/access_tokens", s.apiURL, s.installationID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("could not get an access token for GitHub App installation %d: github returned status code %d", s.installationID, resp.StatusCode)
+	}
+
+	token := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+
+	simplelog.Infof("Received a new access token for GitHub App installation %d, which expires at %s", s.installationID, token.ExpiresAt)
+
+	return &oauth2.Token{
+		AccessToken: token.Token,
+		TokenType:   "token",
+		Expiry:      token.ExpiresAt,
+	}, nil
+}
+
+// jwt returns a JWT signed with the app's private key, which can be used to
+// authenticate as the app itself.
+func (s *githubAppTokenSource) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	// iat is set in the past to allow for clock drift
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": int64(s.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded RSA private key in either PKCS#1
+// (which is what GitHub provides) or PKCS#8 format.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrGithubAppInvalidPrivateKey
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ErrGithubAppInvalidPrivateKey
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrGithubAppInvalidPrivateKey
+	}
+
+	return rsaKey, nil
+}
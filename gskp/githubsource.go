@@ -0,0 +1,141 @@
+package gskp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// teamIndexMissRefreshInterval limits how often the team index is
+	// refreshed because of requests for teams that are not in it.
+	teamIndexMissRefreshInterval = time.Minute
+)
+
+// GithubKeySource is a KeySource that maps GitHub teams of an organisation to
+// their members, using a KeyCollector. When IncludeChildTeams is set, the
+// members of all child teams are included in a team's members. When
+// UseGraphQL is set, members and their keys are collected with the GraphQL
+// API, which takes far fewer requests.
+type GithubKeySource struct {
+	collector         *KeyCollector
+	organisation      string
+	teamIndex         map[string]int
+	teamIndexUpdated  time.Time
+	teamIndexTTL      time.Duration
+	mutex             *sync.Mutex
+	IncludeChildTeams bool
+	UseGraphQL        bool
+}
+
+// NewGithubKeySource returns a GithubKeySource for the specified GitHub
+// organisation, which will use the provided KeyCollector. The index of the
+// organisation's teams is refreshed every teamIndexTTL.
+func NewGithubKeySource(collector *KeyCollector, githubOrg string, teamIndexTTL time.Duration) *GithubKeySource {
+	return &GithubKeySource{
+		collector:    collector,
+		organisation: githubOrg,
+		teamIndex:    map[string]int{},
+		teamIndexTTL: teamIndexTTL,
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// RateLimit returns the last known state of the GitHub API rate limit.
+func (s *GithubKeySource) RateLimit() RateLimitStatus {
+	return s.collector.RateLimit()
+}
+
+// HTTPCacheStats returns the hit and miss counts of the cache for conditional
+// requests to GitHub.
+func (s *GithubKeySource) HTTPCacheStats() HTTPCacheStats {
+	return s.collector.HTTPCacheStats()
+}
+
+// GetGroupMemberInfo returns the members of the GitHub team with the provided
+// slug or name. If the team cannot be found, ErrTeamNotFound is returned.
+func (s *GithubKeySource) GetGroupMemberInfo(teamName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	id, err := s.getTeamID(teamName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.getTeamMemberInfo(id, lastKnown)
+	if isNotFound(err) {
+		// the team could have been deleted or renamed since the index was
+		// last refreshed
+		simplelog.Infof("team '%s' with id %d was not found, refreshing the team index", teamName, id)
+
+		id, err = s.getTeamID(teamName, true)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = s.getTeamMemberInfo(id, lastKnown)
+	}
+	if isNotFound(err) {
+		return nil, ErrTeamNotFound
+	}
+
+	return data, err
+}
+
+// getTeamID looks the team up in the team index, which maps team slugs and
+// names to IDs. The index is refreshed when it is older than teamIndexTTL,
+// when forceRefresh is set or when the team is missing from it (at most once
+// every teamIndexMissRefreshInterval).
+func (s *GithubKeySource) getTeamID(teamName string, forceRefresh bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, exists := s.teamIndex[teamName]
+	indexAge := time.Since(s.teamIndexUpdated)
+
+	if forceRefresh || indexAge >= s.teamIndexTTL || (!exists && indexAge >= teamIndexMissRefreshInterval) {
+		teamIndex, err := s.collector.GetTeamIndex(s.organisation)
+		if err != nil {
+			return -1, err
+		}
+
+		s.teamIndex = teamIndex
+		s.teamIndexUpdated = time.Now()
+	}
+
+	id, exists := s.teamIndex[teamName]
+	if !exists {
+		return -1, ErrTeamNotFound
+	}
+
+	simplelog.Debugf("Team '%s' with id %d found in organization '%s'", teamName, id, s.organisation)
+
+	return id, nil
+}
+
+func (s *GithubKeySource) getTeamMemberInfo(teamID int, lastKnown []UserInfo) ([]UserInfo, error) {
+	if s.UseGraphQL {
+		return s.collector.GetTeamMemberInfoGraphQL(s.organisation, teamID, s.IncludeChildTeams, lastKnown)
+	}
+
+	if s.IncludeChildTeams {
+		return s.collector.GetNestedTeamMemberInfo(teamID, lastKnown)
+	}
+
+	return s.collector.GetTeamMemberInfo(teamID, lastKnown)
+}
+
+// isNotFound returns true if err is a GitHub API error with a 404 status code,
+// or ErrTeamNotFound from a GraphQL query.
+func isNotFound(err error) bool {
+	if err == ErrTeamNotFound {
+		return true
+	}
+
+	if errResp, ok := err.(*github.ErrorResponse); ok && errResp.Response != nil {
+		return errResp.Response.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
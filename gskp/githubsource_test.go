@@ -0,0 +1,95 @@
+package gskp
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+func TestGithubKeySource_GetGroupMemberInfo(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"orgTeams", "userKeys", "userInfo", "teamUserList"})
+	defer mockTeardown()
+
+	source := NewGithubKeySource(testKeyCollector, "none", time.Hour)
+
+	miExpected := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}},
+	}
+
+	mi, err := source.GetGroupMemberInfo("Owners", nil)
+	if err != nil {
+		t.Fatalf("GithubKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("GithubKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	if _, err := source.GetGroupMemberInfo("invalid", nil); err != ErrTeamNotFound {
+		t.Errorf("GithubKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
+
+func TestGithubKeySource_GetGroupMemberInfo_teamRenamedAndDeleted(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"userKeys", "userInfo"})
+	defer mockTeardown()
+
+	teamsList := `[{"name": "Owners", "id": 888888}]`
+	activeTeamID := 888888
+
+	testMux.HandleFunc("/orgs/none/teams", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, teamsList)
+	})
+	for _, id := range []int{888888, 777777} {
+		id := id
+		testMux.HandleFunc(fmt.Sprintf("/teams/%d/members", id), func(w http.ResponseWriter, r *http.Request) {
+			if id != activeTeamID {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+			fmt.Fprint(w, `[{"login": "user", "id": 999999}]`)
+		})
+	}
+
+	source := NewGithubKeySource(testKeyCollector, "none", time.Hour)
+
+	if _, err := source.GetGroupMemberInfo("Owners", nil); err != nil {
+		t.Fatalf("GithubKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	// the team is deleted and a new one is created with the same name
+	teamsList = `[{"name": "Owners", "id": 777777}]`
+	activeTeamID = 777777
+
+	mi, err := source.GetGroupMemberInfo("Owners", nil)
+	if err != nil {
+		t.Fatalf("GithubKeySource.GetGroupMemberInfo returned an error after the team was replaced: %v", err)
+	}
+
+	if len(mi) != 1 {
+		t.Errorf("GithubKeySource.GetGroupMemberInfo returned unexpected value after the team was replaced: %v", mi)
+	}
+
+	if id := source.teamIndex["Owners"]; id != 777777 {
+		t.Errorf("GithubKeySource.GetGroupMemberInfo did not refresh the team index, got %d", id)
+	}
+
+	// the team is deleted altogether
+	teamsList = `[]`
+	activeTeamID = 0
+
+	if _, err := source.GetGroupMemberInfo("Owners", nil); err != ErrTeamNotFound {
+		t.Fatalf("GithubKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package gskp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+// GitlabKeySource is a KeySource that maps GitLab groups, including all of
+// their subgroups, to their members and the SSH keys of those members. Groups
+// are identified by their full path (eg. "infra/platform").
+//
+// It authenticates with a personal or group access token. The Source of the
+// users is "gitlab", so that their GitLab IDs are never mistaken for the IDs of
+// GitHub users.
+type GitlabKeySource struct {
+	baseURL     string
+	accessToken string
+	httpClient  *http.Client
+}
+
+const (
+	// gitlabKeySourceName is the Source of the users of a GitlabKeySource.
+	gitlabKeySourceName = "gitlab"
+
+	// gitlabRequestTimeout is how long to wait for a single request to the
+	// GitLab API, like the timeout for a GitHub team member.
+	gitlabRequestTimeout = 30 * time.Second
+)
+
+type gitlabGroup struct {
+	ID       int    `json:"id"`
+	FullPath string `json:"full_path"`
+}
+
+type gitlabMember struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+}
+
+type gitlabKey struct {
+	Key string `json:"key"`
+}
+
+// gitlabError is returned when the GitLab API responds with an unexpected
+// status code.
+type gitlabError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *gitlabError) Error() string {
+	return fmt.Sprintf("GitLab API returned status code %d for %s", e.StatusCode, e.URL)
+}
+
+// NewGitlabKeySource returns a GitlabKeySource for the GitLab instance at the
+// provided base URL (eg. "https://gitlab.example.com/"), which will use the
+// provided access token.
+func NewGitlabKeySource(baseURL string, accessToken string) (*GitlabKeySource, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, err
+	}
+
+	return &GitlabKeySource{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		accessToken: accessToken,
+		httpClient:  &http.Client{Timeout: gitlabRequestTimeout},
+	}, nil
+}
+
+func (s *GitlabKeySource) userSource() string {
+	return gitlabKeySourceName
+}
+
+// GetGroupMemberInfo returns the members of the GitLab group with the provided
+// full path and the members of all its subgroups. Each user is only included
+// once and the GrantedBy field is set to the group through which they were
+// first found. If the group does not exist, ErrTeamNotFound is returned.
+func (s *GitlabKeySource) GetGroupMemberInfo(groupPath string, lastKnown []UserInfo) ([]UserInfo, error) {
+	simplelog.Debugf("Fetching details for GitLab group '%s'", groupPath)
+
+	group := gitlabGroup{}
+	if _, err := s.get("groups/"+url.PathEscape(groupPath), nil, &group); err != nil {
+		if gerr, ok := err.(*gitlabError); ok && gerr.StatusCode == http.StatusNotFound {
+			return nil, ErrTeamNotFound
+		}
+		return nil, err
+	}
+
+	memberInfo := []UserInfo{}
+	seenUsers := map[int]bool{}
+	seenGroups := map[int]bool{group.ID: true}
+	queue := []gitlabGroup{group}
+	lastKnownByID := indexUserInfo(lastKnown)
+
+	for len(queue) > 0 {
+		g := queue[0]
+		queue = queue[1:]
+
+		members := []gitlabMember{}
+		if err := s.getAllPages(fmt.Sprintf("groups/%d/members", g.ID), func() interface{} { return &[]gitlabMember{} }, func(page interface{}) {
+			members = append(members, *page.(*[]gitlabMember)...)
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, m := range members {
+			if seenUsers[m.ID] {
+				continue
+			}
+			seenUsers[m.ID] = true
+
+			if m.State != "" && m.State != "active" {
+				simplelog.Infof("Skipping GitLab user '%s' with state '%s'", m.Username, m.State)
+				continue
+			}
+
+			ui := UserInfo{
+				Login:     m.Username,
+				ID:        m.ID,
+				Source:    gitlabKeySourceName,
+				Name:      m.Name,
+				Keys:      []SSHKey{},
+				GrantedBy: g.FullPath,
+			}
+
+			keys, err := s.getUserKeys(m.ID, m.Username)
+			if previous, hasPrevious := lastKnownByID[m.ID]; err != nil && hasPrevious && len(previous.Keys) > 0 {
+				simplelog.Infof("Could not fetch keys for GitLab user '%s', using last known keys: %v", m.Username, err)
+				ui.Keys = previous.Keys
+				ui.Stale = true
+			} else if err != nil {
+				simplelog.Infof("Could not fetch keys for GitLab user '%s': %v", m.Username, err)
+			} else {
+				ui.Keys = keys
+			}
+
+			if len(ui.Keys) == 0 {
+				simplelog.Infof("No public SSH keys for GitLab user '%s'", m.Username)
+				continue
+			}
+
+			memberInfo = append(memberInfo, ui)
+		}
+
+		subgroups := []gitlabGroup{}
+		if err := s.getAllPages(fmt.Sprintf("groups/%d/subgroups", g.ID), func() interface{} { return &[]gitlabGroup{} }, func(page interface{}) {
+			subgroups = append(subgroups, *page.(*[]gitlabGroup)...)
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, sg := range subgroups {
+			if seenGroups[sg.ID] {
+				continue
+			}
+
+			seenGroups[sg.ID] = true
+			queue = append(queue, sg)
+		}
+	}
+
+	return memberInfo, nil
+}
+
+func (s *GitlabKeySource) getUserKeys(userID int, username string) ([]SSHKey, error) {
+	simplelog.Debugf("Fetching keys for GitLab user '%s'", username)
+
+	gitlabKeys := []gitlabKey{}
+	if err := s.getAllPages(fmt.Sprintf("users/%d/keys", userID), func() interface{} { return &[]gitlabKey{} }, func(page interface{}) {
+		gitlabKeys = append(gitlabKeys, *page.(*[]gitlabKey)...)
+	}); err != nil {
+		return nil, err
+	}
+
+	keys := []SSHKey{}
+	for _, gk := range gitlabKeys {
+		key, err := ParseSSHKey(gk.Key)
+		if err != nil {
+			simplelog.Infof("Rejected invalid SSH key for GitLab user '%s': %v", username, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// getAllPages requests every page of a paginated endpoint. newPage should
+// return a pointer to a new value to decode a page into and addPage is called
+// with that value for each page.
+func (s *GitlabKeySource) getAllPages(endpoint string, newPage func() interface{}, addPage func(interface{})) error {
+	page := "1"
+
+	for page != "" {
+		v := newPage()
+
+		nextPage, err := s.get(endpoint, url.Values{"page": {page}, "per_page": {"100"}}, v)
+		if err != nil {
+			return err
+		}
+
+		addPage(v)
+		page = nextPage
+	}
+
+	return nil
+}
+
+// get requests an endpoint of the GitLab API and decodes the JSON response
+// into v. It returns the value of the X-Next-Page header.
+func (s *GitlabKeySource) get(endpoint string, query url.Values, v interface{}) (string, error) {
+	u, err := url.Parse(s.baseURL + "/api/v4/" + endpoint)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("PRIVATE-TOKEN", s.accessToken)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &gitlabError{StatusCode: resp.StatusCode, URL: u.String()}
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", err
+	}
+
+	nextPage := resp.Header.Get("X-Next-Page")
+	if _, err := strconv.Atoi(nextPage); err != nil {
+		nextPage = ""
+	}
+
+	return nextPage, nil
+}
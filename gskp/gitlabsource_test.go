@@ -0,0 +1,117 @@
+package gskp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+// newTestGitlabServer returns a fake GitLab server with an "infra/platform"
+// group that has an "infra/platform/sre" subgroup.
+func newTestGitlabServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v4/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "gitlab_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "401 Unauthorized"}`)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/api/v4/groups/infra%2Fplatform":
+			fmt.Fprint(w, `{"id": 10, "full_path": "infra/platform"}`)
+		case "/api/v4/groups/10/members":
+			if r.URL.Query().Get("page") == "1" {
+				w.Header().Set("X-Next-Page", "2")
+				fmt.Fprint(w, `[{"id": 1, "username": "alice", "name": "Alice", "state": "active"}]`)
+				return
+			}
+			w.Header().Set("X-Next-Page", "")
+			fmt.Fprint(w, `[{"id": 2, "username": "bob", "name": "Bob", "state": "blocked"}]`)
+		case "/api/v4/groups/10/subgroups":
+			fmt.Fprint(w, `[{"id": 11, "full_path": "infra/platform/sre"}]`)
+		case "/api/v4/groups/11/members":
+			fmt.Fprint(w, `[{"id": 1, "username": "alice", "name": "Alice", "state": "active"}, {"id": 3, "username": "carol", "name": "Carol", "state": "active"}]`)
+		case "/api/v4/groups/11/subgroups":
+			fmt.Fprint(w, `[]`)
+		case "/api/v4/users/1/keys":
+			fmt.Fprintf(w, `[{"id": 100, "title": "laptop", "key": "%s"}]`, testPublicKey)
+		case "/api/v4/users/3/keys":
+			fmt.Fprintf(w, `[{"id": 101, "title": "desktop", "key": "%s"}, {"id": 102, "title": "broken", "key": "ssh-rsa broken"}]`, testSSHKeyRSA)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "404 Not Found"}`)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestGitlabKeySource_GetGroupMemberInfo(t *testing.T) {
+	server := newTestGitlabServer(t)
+	defer server.Close()
+
+	source, err := NewGitlabKeySource(server.URL+"/", "gitlab_token")
+	if err != nil {
+		t.Fatalf("NewGitlabKeySource returned an error: %v", err)
+	}
+
+	miExpected := []UserInfo{
+		UserInfo{Login: "alice", ID: 1, Source: gitlabKeySourceName, Name: "Alice", Keys: []SSHKey{testSSHKey}, GrantedBy: "infra/platform"},
+		UserInfo{Login: "carol", ID: 3, Source: gitlabKeySourceName, Name: "Carol", Keys: []SSHKey{testSSHKeyRSA}, GrantedBy: "infra/platform/sre"},
+	}
+
+	mi, err := source.GetGroupMemberInfo("infra/platform", nil)
+	if err != nil {
+		t.Fatalf("GitlabKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("GitlabKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	if _, err := source.GetGroupMemberInfo("infra/unknown", nil); err != ErrTeamNotFound {
+		t.Errorf("GitlabKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
+
+func TestGitlabKeySource_GetGroupMemberInfo_unauthorized(t *testing.T) {
+	server := newTestGitlabServer(t)
+	defer server.Close()
+
+	source, _ := NewGitlabKeySource(server.URL, "wrong_token")
+
+	_, err := source.GetGroupMemberInfo("infra/platform", nil)
+	if gerr, ok := err.(*gitlabError); !ok || gerr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GitlabKeySource.GetGroupMemberInfo returned an unexpected error: %v", err)
+	}
+}
+
+func TestGitlabKeySource_GetGroupMemberInfo_timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	source, _ := NewGitlabKeySource(server.URL, "test_token")
+	if source.httpClient.Timeout != gitlabRequestTimeout {
+		t.Fatalf("GitlabKeySource has an unexpected request timeout: %v", source.httpClient.Timeout)
+	}
+	source.httpClient.Timeout = 50 * time.Millisecond
+
+	if _, err := source.GetGroupMemberInfo("infra/platform", nil); err == nil {
+		t.Errorf("GitlabKeySource.GetGroupMemberInfo should have returned an error for a server that does not respond")
+	}
+}
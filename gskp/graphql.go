@@ -0,0 +1,346 @@
+package gskp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// githubGraphQLMembersQuery returns a page of the members of a team, along
+	// with their names and public keys. The membership is formatted into the
+	// query: ALL includes the members of child teams like the REST API, while
+	// IMMEDIATE is used when the child teams are walked separately.
+	githubGraphQLMembersQuery = `query($org: String!, $slug: String!, $cursor: String) {
+  organization(login: $org) {
+    team(slug: $slug) {
+      members(first: 100, after: $cursor, membership: %s) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          login
+          databaseId
+          name
+          publicKeys(first: 100) { totalCount nodes { key } }
+        }
+      }
+    }
+  }
+}`
+
+	// githubGraphQLChildTeamsQuery returns a page of the direct child teams of
+	// a team.
+	githubGraphQLChildTeamsQuery = `query($org: String!, $slug: String!, $cursor: String) {
+  organization(login: $org) {
+    team(slug: $slug) {
+      childTeams(first: 100, after: $cursor, immediateOnly: true) {
+        pageInfo { hasNextPage endCursor }
+        nodes { slug }
+      }
+    }
+  }
+}`
+)
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type graphQLError struct {
+	Type    string        `json:"type"`
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path"`
+}
+
+// memberKeysIndex returns the index of the member in the page whose public
+// keys could not be resolved, if the error is about the keys of a member.
+func (e graphQLError) memberKeysIndex() (int, bool) {
+	// eg. ["organization", "team", "members", "nodes", 3, "publicKeys"]
+	if len(e.Path) < 6 || e.Path[2] != "members" || e.Path[3] != "nodes" || e.Path[5] != "publicKeys" {
+		return 0, false
+	}
+
+	i, ok := e.Path[4].(float64)
+
+	return int(i), ok
+}
+
+type graphQLPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+type graphQLMember struct {
+	Login      string  `json:"login"`
+	DatabaseID int     `json:"databaseId"`
+	Name       *string `json:"name"`
+	PublicKeys struct {
+		TotalCount int `json:"totalCount"`
+		Nodes      []struct {
+			Key string `json:"key"`
+		} `json:"nodes"`
+	} `json:"publicKeys"`
+}
+
+type graphQLTeamResponse struct {
+	Data struct {
+		Organization *struct {
+			Team *struct {
+				Members *struct {
+					PageInfo graphQLPageInfo `json:"pageInfo"`
+					Nodes    []graphQLMember `json:"nodes"`
+				} `json:"members"`
+				ChildTeams *struct {
+					PageInfo graphQLPageInfo `json:"pageInfo"`
+					Nodes    []struct {
+						Slug string `json:"slug"`
+					} `json:"nodes"`
+				} `json:"childTeams"`
+			} `json:"team"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []graphQLError `json:"errors"`
+}
+
+// GetTeamMemberInfoGraphQL returns the same information as GetTeamMemberInfo,
+// or GetNestedTeamMemberInfo if includeChildTeams is set, but uses the GitHub
+// GraphQL API. The members of a team, along with their names and keys, are
+// fetched in pages of 100, instead of making several requests per member.
+//
+// The GraphQL API identifies teams by their slug, so the team is looked up
+// with the REST API first. As with GetTeamMemberInfo, members whose keys
+// cannot be resolved fall back to their entry in lastKnown, marked as stale.
+func (k *KeyCollector) GetTeamMemberInfoGraphQL(organizationName string, teamID int, includeChildTeams bool, lastKnown []UserInfo) ([]UserInfo, error) {
+	simplelog.Debugf("Fetching details for team with ID %d", teamID)
+
+	team, _, err := k.githubClient.Organizations.GetTeam(teamID)
+	if err != nil {
+		return nil, err
+	}
+
+	lastKnownByID := indexUserInfo(lastKnown)
+
+	if !includeChildTeams {
+		return k.getTeamMemberInfoGraphQL(organizationName, teamIdentifier(team), "ALL", map[int]bool{}, lastKnownByID)
+	}
+
+	// walk the team tree first, so that every team comes after its parent
+	teams := []string{teamIdentifier(team)}
+	seenTeams := map[string]bool{teams[0]: true}
+
+	for i := 0; i < len(teams); i++ {
+		childTeams, err := k.getChildTeamsGraphQL(organizationName, teams[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ct := range childTeams {
+			if !seenTeams[ct] {
+				seenTeams[ct] = true
+				teams = append(teams, ct)
+			}
+		}
+	}
+
+	// like GetNestedTeamMemberInfo, users are credited to the most specific
+	// team they belong to
+	teamMemberInfo := make([][]UserInfo, len(teams))
+	seenUsers := map[int]bool{}
+
+	for i := len(teams) - 1; i >= 0; i-- {
+		teamMemberInfo[i], err = k.getTeamMemberInfoGraphQL(organizationName, teams[i], "IMMEDIATE", seenUsers, lastKnownByID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	memberInfo := []UserInfo{}
+	for i, slug := range teams {
+		for _, ui := range teamMemberInfo[i] {
+			ui.GrantedBy = slug
+			memberInfo = append(memberInfo, ui)
+		}
+	}
+
+	return memberInfo, nil
+}
+
+// getTeamMemberInfoGraphQL collects the UserInfo for the members of the team
+// with the provided membership (ALL or IMMEDIATE), skipping any user that is
+// already in seenUsers. Users whose keys cannot be resolved fall back to their
+// entry in lastKnown.
+func (k *KeyCollector) getTeamMemberInfoGraphQL(organizationName string, slug string, membership string, seenUsers map[int]bool, lastKnown map[int]UserInfo) ([]UserInfo, error) {
+	simplelog.Debugf("Fetching a list of users in team '%s' with GraphQL", slug)
+
+	memberInfo := []UserInfo{}
+	var cursor *string
+
+	for {
+		resp := graphQLTeamResponse{}
+		if err := k.graphQL(fmt.Sprintf(githubGraphQLMembersQuery, membership), organizationName, slug, cursor, &resp); err != nil {
+			return nil, err
+		}
+
+		members := resp.Data.Organization.Team.Members
+		if members == nil {
+			return nil, fmt.Errorf("GitHub GraphQL response for team '%s' has no members", slug)
+		}
+
+		failedKeys := map[int]string{}
+		for _, e := range resp.Errors {
+			if i, ok := e.memberKeysIndex(); ok {
+				failedKeys[i] = e.Message
+			}
+		}
+
+		for i, m := range members.Nodes {
+			if seenUsers[m.DatabaseID] {
+				simplelog.Debugf("User '%s' has already been processed, skipping", m.Login)
+				continue
+			}
+			seenUsers[m.DatabaseID] = true
+
+			ui := UserInfo{
+				Login: m.Login,
+				ID:    m.DatabaseID,
+				Name:  "unknown name",
+				Keys:  []SSHKey{},
+			}
+
+			if m.Name != nil {
+				ui.Name = *m.Name
+			}
+
+			if message, failed := failedKeys[i]; failed {
+				if previous, exists := lastKnown[m.DatabaseID]; exists && len(previous.Keys) > 0 {
+					simplelog.Infof("Could not fetch keys for user '%s', using last known keys: %s", m.Login, message)
+					ui.Keys = previous.Keys
+					ui.Stale = true
+				} else {
+					simplelog.Infof("Could not fetch keys for user '%s': %s", m.Login, message)
+				}
+			} else {
+				if m.PublicKeys.TotalCount > len(m.PublicKeys.Nodes) {
+					simplelog.Infof("User '%s' has %d public SSH keys, only the first %d are used", m.Login, m.PublicKeys.TotalCount, len(m.PublicKeys.Nodes))
+				}
+
+				for _, node := range m.PublicKeys.Nodes {
+					key, err := ParseSSHKey(node.Key)
+					if err != nil {
+						simplelog.Infof("Rejected invalid SSH key for user '%s': %v", m.Login, err)
+						continue
+					}
+
+					ui.Keys = append(ui.Keys, key)
+				}
+			}
+
+			if len(ui.Keys) == 0 {
+				simplelog.Infof("No public SSH keys for user '%s'", m.Login)
+				continue
+			}
+
+			memberInfo = append(memberInfo, ui)
+		}
+
+		if !members.PageInfo.HasNextPage {
+			break
+		}
+
+		cursor = &members.PageInfo.EndCursor
+	}
+
+	return memberInfo, nil
+}
+
+// getChildTeamsGraphQL returns the slugs of the direct child teams of the team.
+func (k *KeyCollector) getChildTeamsGraphQL(organizationName string, slug string) ([]string, error) {
+	childTeams := []string{}
+	var cursor *string
+
+	for {
+		resp := graphQLTeamResponse{}
+		if err := k.graphQL(githubGraphQLChildTeamsQuery, organizationName, slug, cursor, &resp); err != nil {
+			return nil, err
+		}
+
+		teams := resp.Data.Organization.Team.ChildTeams
+		if teams == nil {
+			return nil, fmt.Errorf("GitHub GraphQL response for team '%s' has no child teams", slug)
+		}
+
+		for _, t := range teams.Nodes {
+			childTeams = append(childTeams, t.Slug)
+		}
+
+		if !teams.PageInfo.HasNextPage {
+			break
+		}
+
+		cursor = &teams.PageInfo.EndCursor
+	}
+
+	return childTeams, nil
+}
+
+// graphQL runs a query about a team and decodes the response into resp. If
+// GitHub reports that the organization or the team do not exist,
+// ErrTeamNotFound is returned.
+func (k *KeyCollector) graphQL(query string, organizationName string, slug string, cursor *string, resp *graphQLTeamResponse) error {
+	req, err := k.githubClient.NewRequest("POST", k.graphQLURL(), graphQLRequest{
+		Query: query,
+		Variables: map[string]interface{}{
+			"org":    organizationName,
+			"slug":   slug,
+			"cursor": cursor,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := k.githubClient.Do(req, resp); err != nil {
+		return err
+	}
+
+	if resp.Data.Organization == nil || resp.Data.Organization.Team == nil {
+		// only a NOT_FOUND error means that the team is gone, any other
+		// failure has to keep the last known keys
+		notFound := false
+		for _, e := range resp.Errors {
+			if e.Type != "NOT_FOUND" {
+				return fmt.Errorf("GitHub GraphQL query for team '%s' failed: %s", slug, e.Message)
+			}
+			notFound = true
+		}
+
+		if !notFound {
+			return fmt.Errorf("GitHub GraphQL response for team '%s' has no team", slug)
+		}
+
+		return ErrTeamNotFound
+	}
+
+	// the keys of a single member failing to resolve is left to the caller,
+	// like a failed request for the keys of a member with the REST API
+	for _, e := range resp.Errors {
+		if _, ok := e.memberKeysIndex(); !ok {
+			return fmt.Errorf("GitHub GraphQL query for team '%s' failed: %s", slug, e.Message)
+		}
+	}
+
+	return nil
+}
+
+// graphQLURL returns the URL of the GraphQL API. For GitHub Enterprise Server
+// it is "api/graphql" rather than "api/v3/graphql".
+func (k *KeyCollector) graphQLURL() string {
+	base := strings.TrimSuffix(k.githubClient.BaseURL.String(), "/")
+
+	if strings.HasSuffix(base, "/api/v3") {
+		return strings.TrimSuffix(base, "/v3") + "/graphql"
+	}
+
+	return base + "/graphql"
+}
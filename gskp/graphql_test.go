@@ -0,0 +1,238 @@
+package gskp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// mockInstallGraphQLHandler serves the recorded GraphQL responses in
+// testdata/graphql. Responses are looked up by the kind of query, the team
+// slug and the cursor, eg. "members_engineering_<cursor>.json". Queries for
+// the immediate members of a team use "immediate_members" as their kind.
+func mockInstallGraphQLHandler(t *testing.T, path string) {
+	testMux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Unexpected method for a GraphQL request: %s", r.Method)
+		}
+
+		req := struct {
+			Query     string `json:"query"`
+			Variables struct {
+				Org    string  `json:"org"`
+				Slug   string  `json:"slug"`
+				Cursor *string `json:"cursor"`
+			} `json:"variables"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("Could not decode GraphQL request: %v", err)
+		}
+
+		fixture := "organization_not_found"
+		if req.Variables.Org == "none" {
+			kind := "members"
+			if strings.Contains(req.Query, "childTeams") {
+				kind = "child_teams"
+			} else if strings.Contains(req.Query, "membership: IMMEDIATE") {
+				kind = "immediate_members"
+			}
+
+			fixture = kind + "_" + req.Variables.Slug
+			if req.Variables.Cursor != nil {
+				fixture += "_" + *req.Variables.Cursor
+			}
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "graphql", fixture+".json"))
+		if err != nil {
+			data, _ = ioutil.ReadFile(filepath.Join("testdata", "graphql", "team_not_found.json"))
+		}
+
+		w.Write(data)
+	})
+
+	testMux.HandleFunc("/teams/888888", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Engineering", "slug": "engineering", "id": 888888}`)
+	})
+	testMux.HandleFunc("/teams/777777", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Deleted", "slug": "deleted", "id": 777777}`)
+	})
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL(t *testing.T) {
+	mockSetup()
+	mockInstallGraphQLHandler(t, "/graphql")
+	defer mockTeardown()
+
+	// members of child teams are included, as with the REST API
+	miExpected := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}},
+		UserInfo{Login: "sre", ID: 999998, Name: "SRE User", Keys: []SSHKey{testSSHKeySRE}},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 888888, false, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfoGraphQL returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected value: %v", mi)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL_childTeams(t *testing.T) {
+	mockSetup()
+	mockInstallGraphQLHandler(t, "/graphql")
+	defer mockTeardown()
+
+	// each member is credited to the team they are an immediate member of,
+	// as with the REST API
+	miExpected := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}, GrantedBy: "engineering"},
+		UserInfo{Login: "sre", ID: 999998, Name: "SRE User", Keys: []SSHKey{testSSHKeySRE}, GrantedBy: "platform"},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 888888, true, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfoGraphQL returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected value: %v", mi)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL_notFound(t *testing.T) {
+	mockSetup()
+	mockInstallGraphQLHandler(t, "/graphql")
+	defer mockTeardown()
+
+	if _, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 777777, false, nil); err != ErrTeamNotFound {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected error for a missing team: %v", err)
+	}
+
+	if _, err := testKeyCollector.GetTeamMemberInfoGraphQL("missing", 888888, false, nil); err != ErrTeamNotFound {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected error for a missing organization: %v", err)
+	}
+
+	if _, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 666666, false, nil); !isNotFound(err) {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected error for an unknown team ID: %v", err)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL_errors(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	testMux.HandleFunc("/teams/888888", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Engineering", "slug": "engineering", "id": 888888}`)
+	})
+	testMux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": null, "errors": [{"type": "MAX_NODE_LIMIT_EXCEEDED", "message": "This query requests too many nodes."}]}`)
+	})
+
+	if _, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 888888, false, nil); err == nil || err == ErrTeamNotFound {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected error: %v", err)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL_missingTeam(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	testMux.HandleFunc("/teams/888888", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Engineering", "slug": "engineering", "id": 888888}`)
+	})
+	testMux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"organization": {"team": null}}}`)
+	})
+
+	// a missing team is only trusted if GitHub reports it as not found, so
+	// that the last known keys are kept otherwise
+	if _, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 888888, false, nil); err == nil || err == ErrTeamNotFound {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected error: %v", err)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfoGraphQL_lastKnownKeys(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	testMux.HandleFunc("/teams/888888", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Engineering", "slug": "engineering", "id": 888888}`)
+	})
+	testMux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+  "data": {"organization": {"team": {"members": {
+    "pageInfo": {"hasNextPage": false, "endCursor": null},
+    "nodes": [
+      {"login": "user", "databaseId": 999999, "name": "User Name", "publicKeys": null},
+      {"login": "sre", "databaseId": 999998, "name": "SRE User", "publicKeys": null}
+    ]
+  }}}},
+  "errors": [
+    {"type": "SERVICE_UNAVAILABLE", "path": ["organization", "team", "members", "nodes", 0, "publicKeys"], "message": "Something went wrong."},
+    {"type": "SERVICE_UNAVAILABLE", "path": ["organization", "team", "members", "nodes", 1, "publicKeys"], "message": "Something went wrong."}
+  ]
+}`)
+	})
+
+	lastKnown := []UserInfo{UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKeyRSA}}}
+
+	// sre has no last known keys, so they are left out
+	miExpected := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKeyRSA}, Stale: true},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfoGraphQL("none", 888888, false, lastKnown)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfoGraphQL returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetTeamMemberInfoGraphQL returned unexpected value: %v", mi)
+	}
+}
+
+func TestGithubKeySource_GetGroupMemberInfo_graphQL(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"orgTeams"})
+	mockInstallGraphQLHandler(t, "/graphql")
+	defer mockTeardown()
+
+	source := NewGithubKeySource(testKeyCollector, "none", time.Minute)
+	source.UseGraphQL = true
+
+	mi, err := source.GetGroupMemberInfo("Owners", nil)
+	if err != nil {
+		t.Fatalf("GithubKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if len(mi) != 2 || mi[0].Login != "user" {
+		t.Errorf("GithubKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+}
+
+func TestKeyCollector_graphQLURL(t *testing.T) {
+	for base, expected := range map[string]string{
+		"https://api.github.com/":            "https://api.github.com/graphql",
+		"https://github.example.com/api/v3/": "https://github.example.com/api/graphql",
+	} {
+		u, _ := url.Parse(base)
+		k := &KeyCollector{githubClient: github.NewClient(nil)}
+		k.githubClient.BaseURL = u
+
+		if graphQLURL := k.graphQLURL(); graphQLURL != expected {
+			t.Errorf("KeyCollector.graphQLURL returned %s for %s, expected %s", graphQLURL, base, expected)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package gskp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/gskppb"
+)
+
+// NewGRPCServerTLSConfig returns the TLS configuration of a gRPC server using
+// mutual TLS. The server presents the certificate and key in certFile and
+// keyFile, and requires clients to present a certificate signed by one of the
+// CAs in clientCAFile.
+func NewGRPCServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, pool, err := loadMutualTLS(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewGRPCClientTLSConfig returns the TLS configuration of a gRPC client using
+// mutual TLS. The client presents the certificate and key in certFile and
+// keyFile, and only trusts servers with a certificate signed by one of the CAs
+// in caFile.
+func NewGRPCClientTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, pool, err := loadMutualTLS(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadMutualTLS(certFile string, keyFile string, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	caBundle, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return tls.Certificate{}, nil, ErrInvalidCABundle
+	}
+
+	return cert, pool, nil
+}
+
+func keySetToProto(teamName string, set KeySet) *gskppb.KeySet {
+	pb := &gskppb.KeySet{
+		Team:       teamName,
+		Version:    set.Version,
+		AgeSeconds: int64(set.Age.Seconds()),
+	}
+
+	for _, ui := range set.Users {
+		user := &gskppb.User{
+			Login:     ui.Login,
+			Id:        int64(ui.ID),
+			Source:    ui.Source,
+			Name:      ui.Name,
+			GrantedBy: ui.GrantedBy,
+			Stale:     ui.Stale,
+		}
+
+		for _, key := range ui.Keys {
+			user.Keys = append(user.Keys, sshKeyToProto(key))
+		}
+
+		for _, rejected := range ui.RejectedKeys {
+			user.RejectedKeys = append(user.RejectedKeys, &gskppb.RejectedSSHKey{
+				Key:    sshKeyToProto(rejected.SSHKey),
+				Reason: rejected.Reason,
+			})
+		}
+
+		pb.Users = append(pb.Users, user)
+	}
+
+	return pb
+}
+
+func sshKeyToProto(key SSHKey) *gskppb.SSHKey {
+	return &gskppb.SSHKey{
+		Type:        key.Type,
+		Bits:        int32(key.Bits),
+		Fingerprint: key.Fingerprint,
+		Comment:     key.Comment,
+		Key:         key.Key,
+	}
+}
+
+func userInfoFromProto(pb *gskppb.KeySet) []UserInfo {
+	users := []UserInfo{}
+
+	for _, user := range pb.GetUsers() {
+		ui := UserInfo{
+			Login:     user.GetLogin(),
+			ID:        int(user.GetId()),
+			Source:    user.GetSource(),
+			Name:      user.GetName(),
+			Keys:      []SSHKey{},
+			GrantedBy: user.GetGrantedBy(),
+			Stale:     user.GetStale(),
+		}
+
+		for _, key := range user.GetKeys() {
+			ui.Keys = append(ui.Keys, sshKeyFromProto(key))
+		}
+
+		for _, rejected := range user.GetRejectedKeys() {
+			ui.RejectedKeys = append(ui.RejectedKeys, RejectedSSHKey{
+				SSHKey: sshKeyFromProto(rejected.GetKey()),
+				Reason: rejected.GetReason(),
+			})
+		}
+
+		users = append(users, ui)
+	}
+
+	return users
+}
+
+func sshKeyFromProto(pb *gskppb.SSHKey) SSHKey {
+	return SSHKey{
+		Type:        pb.GetType(),
+		Bits:        int(pb.GetBits()),
+		Fingerprint: pb.GetFingerprint(),
+		Comment:     pb.GetComment(),
+		Key:         pb.GetKey(),
+	}
+}
@@ -0,0 +1,253 @@
+package gskp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	_ KeyClient = &Client{}
+	_ KeyClient = &GRPCClient{}
+)
+
+// testWriteCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil, and writes it and its key to dir.
+func testWriteCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate a key: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("could not create a certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal a key: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return cert, key
+}
+
+// testGRPCSetup starts a gRPC server with mutual TLS for the cache, and
+// returns its address along with the TLS configuration of a valid client.
+func testGRPCSetup(t *testing.T, cache *KeyCache) (*Server, string, *tls.Config, func()) {
+	dir, err := ioutil.TempDir("", "gskp")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+
+	ca, caKey := testWriteCert(t, dir, "ca", &x509.Certificate{}, nil, nil)
+	testWriteCert(t, dir, "server", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}, ca, caKey)
+	testWriteCert(t, dir, "client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverTLS, err := NewGRPCServerTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("NewGRPCServerTLSConfig returned an error: %v", err)
+	}
+
+	clientTLS, err := NewGRPCClientTLSConfig(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("NewGRPCClientTLSConfig returned an error: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+
+	s, _ := NewServer(cache)
+	grpcServer := s.GRPCServer(serverTLS)
+	go grpcServer.Serve(listener)
+	go s.updateManager()
+
+	teardown := func() {
+		close(s.streamStop)
+		s.updateManagerStop <- true
+		grpcServer.GracefulStop()
+		os.RemoveAll(dir)
+	}
+
+	return s, listener.Addr().String(), clientTLS, teardown
+}
+
+func TestGRPCClient(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Source: ldapKeySourceName, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	_, address, clientTLS, teardown := testGRPCSetup(t, cache)
+	defer teardown()
+
+	client, err := NewGRPCClient(address, clientTLS)
+	if err != nil {
+		t.Fatalf("NewGRPCClient returned an error: %v", err)
+	}
+	defer client.Close()
+	client.streamReconnectDelay = 10 * time.Millisecond
+
+	data, err := client.GetKeys("deploy")
+	if err != nil {
+		t.Fatalf("GRPCClient.GetKeys returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(data, source.groups["deploy"]) {
+		t.Errorf("GRPCClient.GetKeys returned unexpected value: %v", data)
+	}
+
+	if _, err := client.GetKeys("missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("GRPCClient.GetKeys returned unexpected error for a missing team: %v", err)
+	}
+
+	teams, err := client.ListTeams()
+	if err != nil {
+		t.Fatalf("GRPCClient.ListTeams returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(teams, []string{"deploy"}) {
+		t.Errorf("GRPCClient.ListTeams returned unexpected teams: %v", teams)
+	}
+
+	// the client already has the current keys, so only changes are returned
+	updates := make(chan string, 10)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		client.WatchKeys("deploy", stop, func(data []UserInfo) {
+			updates <- data[0].Name
+		})
+		close(stopped)
+	}()
+
+	testChangeKeys(t, cache, source, "deploy", "Deploy Bot v2")
+
+	select {
+	case update := <-updates:
+		if update != "Deploy Bot v2" {
+			t.Errorf("GRPCClient.WatchKeys returned unexpected keys: %s", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GRPCClient.WatchKeys did not return the changed keys")
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GRPCClient.WatchKeys did not return after being stopped")
+	}
+}
+
+func TestGRPCClient_WatchKeys_deleted(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	_, address, clientTLS, teardown := testGRPCSetup(t, cache)
+	defer teardown()
+
+	client, err := NewGRPCClient(address, clientTLS)
+	if err != nil {
+		t.Fatalf("NewGRPCClient returned an error: %v", err)
+	}
+	defer client.Close()
+	client.streamReconnectDelay = 10 * time.Millisecond
+
+	updates := make(chan []UserInfo, 10)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		client.WatchKeys("deploy", stop, func(data []UserInfo) {
+			// the client keeps retrying, so do not block it
+			select {
+			case updates <- data:
+			default:
+			}
+		})
+		close(stopped)
+	}()
+
+	expectUpdate := func(users int) {
+		select {
+		case update := <-updates:
+			if len(update) != users {
+				t.Errorf("GRPCClient.WatchKeys returned unexpected keys: %v", update)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("GRPCClient.WatchKeys did not return the keys")
+		}
+	}
+
+	expectUpdate(1)
+
+	testDeleteTeam(t, cache, source, "deploy")
+	expectUpdate(0)
+
+	close(stop)
+	<-stopped
+}
+
+func TestGRPCServer_clientCertificateRequired(t *testing.T) {
+	cache := NewKeyCache(&testKeySource{}, time.Hour)
+	_, address, clientTLS, teardown := testGRPCSetup(t, cache)
+	defer teardown()
+
+	withoutCert := clientTLS.Clone()
+	withoutCert.Certificates = nil
+
+	client, err := NewGRPCClient(address, withoutCert)
+	if err != nil {
+		t.Fatalf("NewGRPCClient returned an error: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.ListTeams(); err == nil {
+		t.Error("GRPCClient.ListTeams should have failed without a client certificate")
+	}
+}
@@ -0,0 +1,168 @@
+package gskp
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/gskppb"
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// grpcClientRequestTimeout is the timeout of unary requests to the
+	// collector.
+	grpcClientRequestTimeout = 2 * time.Minute
+)
+
+// GRPCClient can be used by the agent instead of Client, to get keys from the
+// collector's gRPC service. Like Client, it remembers the version of the keys
+// it last received for each team.
+type GRPCClient struct {
+	conn     *grpc.ClientConn
+	client   gskppb.CollectorClient
+	versions map[string]uint64
+	mutex    *sync.Mutex
+
+	streamReconnectDelay time.Duration
+}
+
+// NewGRPCClient creates and returns a new GRPCClient for the collector at
+// address. If tlsConfig is nil, the connection is not encrypted. The
+// connection is only established once it is first used.
+func NewGRPCClient(address string, tlsConfig *tls.Config) (*GRPCClient, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCClient{
+		conn:     conn,
+		client:   gskppb.NewCollectorClient(conn),
+		versions: map[string]uint64{},
+		mutex:    &sync.Mutex{},
+
+		streamReconnectDelay: defaultClientStreamReconnectDelay,
+	}, nil
+}
+
+// Close closes the connection to the collector.
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// GetKeys requests the list of SSH keys from the collector.
+func (c *GRPCClient) GetKeys(teamName string) ([]UserInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcClientRequestTimeout)
+	defer cancel()
+
+	set, err := c.client.GetKeys(ctx, &gskppb.GetKeysRequest{Team: teamName})
+	if err != nil {
+		return nil, err
+	}
+
+	c.setVersion(teamName, set.GetVersion())
+
+	return userInfoFromProto(set), nil
+}
+
+// ListTeams returns the teams the collector has keys for.
+func (c *GRPCClient) ListTeams() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcClientRequestTimeout)
+	defer cancel()
+
+	resp, err := c.client.ListTeams(ctx, &gskppb.ListTeamsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.GetTeams(), nil
+}
+
+// WatchKeys streams updates of the SSH keys from the collector, calling
+// handler with the full list of keys every time they change. Unless the client
+// already has the current version of the keys, the handler is first called
+// with them straight away. Interrupted streams are reconnected with the last
+// version that was received. If the team does not exist or is removed, handler
+// is called with no keys and the stream is retried, in case the team comes
+// back. WatchKeys only returns once stop is closed.
+func (c *GRPCClient) WatchKeys(teamName string, stop <-chan struct{}, handler func([]UserInfo)) {
+	for {
+		err := c.watchKeys(teamName, stop, handler)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		simplelog.Errorf("gRPC stream of key updates for team '%s' was interrupted, reconnecting in %.0f seconds: %v", teamName, c.streamReconnectDelay.Seconds(), err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.streamReconnectDelay):
+		}
+	}
+}
+
+// watchKeys reads a single stream of key updates until it is interrupted.
+func (c *GRPCClient) watchKeys(teamName string, stop <-chan struct{}, handler func([]UserInfo)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	simplelog.Debugf("starting gRPC stream of key updates for team '%s'", teamName)
+
+	stream, err := c.client.WatchKeys(ctx, &gskppb.WatchKeysRequest{Team: teamName, Version: c.version(teamName)})
+	if err != nil {
+		return err
+	}
+
+	for {
+		set, err := stream.Recv()
+		if status.Code(err) == codes.NotFound {
+			c.setVersion(teamName, 0)
+			handler([]UserInfo{})
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		c.setVersion(teamName, set.GetVersion())
+		handler(userInfoFromProto(set))
+	}
+}
+
+func (c *GRPCClient) version(teamName string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.versions[teamName]
+}
+
+func (c *GRPCClient) setVersion(teamName string, version uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.versions[teamName] = version
+}
@@ -0,0 +1,124 @@
+package gskp
+
+import (
+	"context"
+	"crypto/tls"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/gskppb"
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+// grpcCollector implements the gRPC Collector service with the KeyCache and
+// the update notifications of a Server.
+type grpcCollector struct {
+	gskppb.UnimplementedCollectorServer
+	server *Server
+}
+
+// GRPCServer returns a gRPC server providing the Collector service, backed by
+// the same KeyCache as the HTTP server. If tlsConfig is nil, connections are
+// not encrypted. Updates are only pushed to WatchKeys streams while the HTTP
+// server is running, and the streams are ended by Stop, which should be
+// called before stopping the gRPC server.
+func (s *Server) GRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	gskppb.RegisterCollectorServer(server, &grpcCollector{server: s})
+
+	return server
+}
+
+// GetKeys implements gskppb.CollectorServer.
+func (g *grpcCollector) GetKeys(ctx context.Context, req *gskppb.GetKeysRequest) (*gskppb.KeySet, error) {
+	if req.GetTeam() == "" {
+		return nil, status.Error(codes.InvalidArgument, "team is required")
+	}
+
+	set, err := g.server.cache.GetKeySet(req.GetTeam())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return keySetToProto(req.GetTeam(), set), nil
+}
+
+// WatchKeys implements gskppb.CollectorServer.
+func (g *grpcCollector) WatchKeys(req *gskppb.WatchKeysRequest, stream gskppb.Collector_WatchKeysServer) error {
+	team := req.GetTeam()
+	if team == "" {
+		return status.Error(codes.InvalidArgument, "team is required")
+	}
+
+	// make sure the team exists before starting to wait for changes
+	if _, err := g.server.cache.GetKeySet(team); err != nil {
+		return grpcError(err)
+	}
+
+	simplelog.Debugf("new gRPC stream for team '%s'", team)
+
+	version := req.GetVersion()
+	for {
+		// subscribe before comparing versions, so that an update in between
+		// is not missed
+		changed, unsubscribe := g.server.updateManagerBroadcaster.Subscribe(team)
+
+		// the team existed when the stream started, so it has been removed
+		current, exists := g.server.cache.Version(team)
+		if !exists {
+			unsubscribe()
+			return grpcError(ErrTeamNotFound)
+		}
+
+		if current != version {
+			set, err := g.server.cache.GetKeySet(team)
+			if err != nil {
+				unsubscribe()
+				return grpcError(err)
+			}
+
+			if err := stream.Send(keySetToProto(team, set)); err != nil {
+				unsubscribe()
+				return err
+			}
+
+			simplelog.Debugf("sent version %d of the keys for team '%s' to a gRPC stream", set.Version, team)
+			version = set.Version
+		}
+
+		select {
+		case <-changed:
+			unsubscribe()
+		case <-stream.Context().Done():
+			unsubscribe()
+			return stream.Context().Err()
+		case <-g.server.streamStop:
+			unsubscribe()
+			return status.Error(codes.Unavailable, "the collector is shutting down")
+		}
+	}
+}
+
+// ListTeams implements gskppb.CollectorServer.
+func (g *grpcCollector) ListTeams(ctx context.Context, req *gskppb.ListTeamsRequest) (*gskppb.ListTeamsResponse, error) {
+	return &gskppb.ListTeamsResponse{Teams: g.server.cache.Teams()}, nil
+}
+
+// grpcError converts an error from the KeyCache to a gRPC status error.
+func grpcError(err error) error {
+	if err == ErrTeamNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	simplelog.Errorf("error occurred when trying to get keys from cache: %v", err)
+
+	return status.Error(codes.Internal, "unexpected error occurred")
+}
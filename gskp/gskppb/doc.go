@@ -0,0 +1,5 @@
+// Package gskppb contains the protocol buffer messages and the gRPC service of
+// the collector, generated from collector.proto.
+package gskppb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative collector.proto
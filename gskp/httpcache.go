@@ -0,0 +1,219 @@
+package gskp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// defaultHTTPCacheMaxEntries limits the number of responses kept by the
+	// httpCache. The least recently used entry is evicted once it is full.
+	defaultHTTPCacheMaxEntries = 10000
+)
+
+// HTTPCacheStats holds the number of requests that were answered from the
+// HTTP cache after a 304 Not Modified response (Hits) and those that needed a
+// full response (Misses).
+type HTTPCacheStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// HTTPCacheReporter is implemented by KeySources that use an HTTP cache.
+type HTTPCacheReporter interface {
+	HTTPCacheStats() HTTPCacheStats
+}
+
+// httpCache is an http.RoundTripper that stores the responses of GET requests
+// which have an ETag or Last-Modified header and makes conditional requests
+// for them. When the server responds with 304 Not Modified, the stored
+// response is returned instead. GitHub does not count those requests against
+// the rate limit.
+type httpCache struct {
+	base       http.RoundTripper
+	entries    map[string]*httpCacheEntry
+	maxEntries int
+	hits       int64
+	misses     int64
+	mutex      *sync.Mutex
+}
+
+type httpCacheEntry struct {
+	etag         string
+	lastModified string
+	statusCode   int
+	header       http.Header
+	body         []byte
+	lastUsed     time.Time
+}
+
+func newHTTPCache(base http.RoundTripper) *httpCache {
+	return &httpCache{
+		base:       base,
+		entries:    map[string]*httpCacheEntry{},
+		maxEntries: defaultHTTPCacheMaxEntries,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *httpCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return c.base.RoundTrip(req)
+	}
+
+	key := httpCacheKey(req)
+	entry := c.get(key)
+
+	if entry != nil {
+		// requests must not be modified by a RoundTripper
+		conditional := new(http.Request)
+		*conditional = *req
+		conditional.Header = http.Header{}
+		for k, v := range req.Header {
+			conditional.Header[k] = v
+		}
+
+		if entry.etag != "" {
+			conditional.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			conditional.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+
+		req = conditional
+	}
+
+	resp, err := c.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		c.record(true)
+
+		simplelog.Debugf("Using cached response for %s", req.URL.Path)
+
+		return entry.response(req, resp.Header), nil
+	}
+
+	c.record(false)
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// the caller owns the headers of the response, so the cache keeps a copy
+	c.put(key, &httpCacheEntry{
+		etag:         etag,
+		lastModified: lastModified,
+		statusCode:   resp.StatusCode,
+		header:       resp.Header.Clone(),
+		body:         body,
+	})
+
+	return resp, nil
+}
+
+// Stats returns the hit and miss counts of the cache.
+func (c *httpCache) Stats() HTTPCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := HTTPCacheStats{Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+
+	return stats
+}
+
+func (c *httpCache) get(key string) *httpCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	entry.lastUsed = time.Now()
+
+	return entry
+}
+
+func (c *httpCache) put(key string, entry *httpCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry.lastUsed = time.Now()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		oldestKey := ""
+		for k, e := range c.entries {
+			if oldestKey == "" || e.lastUsed.Before(c.entries[oldestKey].lastUsed) {
+				oldestKey = k
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+
+	c.entries[key] = entry
+}
+
+func (c *httpCache) record(hit bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// response builds a response from the cache entry. The headers of the 304
+// response are copied over a copy of the stored ones, so that eg. the rate
+// limit headers are current and changes made by the caller do not reach the
+// cache.
+func (e *httpCacheEntry) response(req *http.Request, notModifiedHeader http.Header) *http.Response {
+	header := e.header.Clone()
+	for k, v := range notModifiedHeader {
+		header[k] = v
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.statusCode, http.StatusText(e.statusCode)),
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// httpCacheKey identifies a cached response. The Accept header is included,
+// since GitHub returns different representations for preview media types.
+func httpCacheKey(req *http.Request) string {
+	return req.URL.String() + " " + req.Header.Get("Accept")
+}
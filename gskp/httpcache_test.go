@@ -0,0 +1,119 @@
+package gskp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPCache(t *testing.T) {
+	version := 1
+	served := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version)
+
+		switch r.URL.Path {
+		case "/etag":
+			if r.Header.Get("If-None-Match") == etag {
+				w.Header().Set("X-RateLimit-Remaining", "4999")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		case "/modified":
+			if r.Header.Get("If-Modified-Since") == "Mon, 02 Jan 2017 15:04:05 GMT" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2017 15:04:05 GMT")
+		}
+
+		served++
+		w.Header().Set("X-RateLimit-Remaining", "5000")
+		fmt.Fprintf(w, "version %d of %s", version, r.URL.Path)
+	}))
+	defer server.Close()
+
+	cache := newHTTPCache(http.DefaultTransport)
+	client := &http.Client{Transport: cache}
+
+	get := func(path string, expected string) *http.Response {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s returned an error: %v", path, err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Errorf("GET %s returned unexpected response: %d %s", path, resp.StatusCode, body)
+		}
+
+		return resp
+	}
+
+	get("/etag", "version 1 of /etag")
+	resp := get("/etag", "version 1 of /etag")
+	if resp.Header.Get("X-RateLimit-Remaining") != "4999" || resp.Header.Get("ETag") != `"v1"` {
+		t.Errorf("cached response has unexpected headers: %v", resp.Header)
+	}
+
+	// changing the headers of a response must not change the cached ones
+	resp = get("/modified", "version 1 of /modified")
+	resp.Header.Set("Last-Modified", "changed")
+	resp = get("/modified", "version 1 of /modified")
+	if resp.Header.Get("Last-Modified") != "Mon, 02 Jan 2017 15:04:05 GMT" {
+		t.Errorf("cached response has unexpected headers: %v", resp.Header)
+	}
+	get("/none", "version 1 of /none")
+	get("/none", "version 1 of /none")
+
+	version = 2
+	get("/etag", "version 2 of /etag")
+	get("/etag", "version 2 of /etag")
+
+	if served != 5 {
+		t.Errorf("expected 5 full responses, got %d", served)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 3 || stats.Misses != 5 || stats.HitRatio != 3.0/8.0 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestHTTPCache_eviction(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	cache := newHTTPCache(http.DefaultTransport)
+	cache.maxEntries = 2
+	client := &http.Client{Transport: cache}
+
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/a", "/b"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s returned an error: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	// "/b" was evicted when "/c" was added, since "/a" had been used since
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 4 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+
+	if len(cache.entries) != 2 {
+		t.Errorf("cache has %d entries, expected at most 2", len(cache.entries))
+	}
+}
@@ -3,109 +3,544 @@ package gskp
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
 )
 
-// KeyCache wraps around the KeyCollector to provide a simple caching mechanism
-// for retrieved SSH keys.
+const (
+	// defaultKeyCacheHistoryLength is how many versions of the keys of each
+	// team are kept for diffs by default.
+	defaultKeyCacheHistoryLength = 20
+)
+
+var (
+	// ErrKeyVersionNotFound is returned when a version of the keys of a team
+	// is not in the history of the cache, either because it never existed or
+	// because it is too old.
+	ErrKeyVersionNotFound = errors.New("version of the keys was not found")
+)
+
+// KeyCache wraps around a KeySource to provide a simple caching mechanism
+// for retrieved SSH keys. Each team is updated independently, so a slow team
+// does not block the others, and concurrent requests for a team that is being
+// updated wait for that update instead of starting another one.
+//
+// Keys older than TTL are still served while they are updated in the
+// background, so a slow or failing source does not hold up clients. Once the
+// keys of a team are older than MaxStaleness, the team is reported by
+// StaleTeams, as long as its keys have been served within MaxStaleness. Teams
+// nobody asks for are not updated, so they are not reported either. A zero
+// MaxStaleness disables the limit.
+//
+// Every change to the keys of a team gives them a new, higher version. The
+// name of a team whose keys changed, or that was removed, is sent on Updates,
+// unless the channel is full, so updating never blocks even if nobody is
+// reading it. Readers should call UpdatedTeams on every message, which returns
+// all the teams that changed, including those that did not fit in the channel.
+// The last HistoryLength versions of each team are kept in memory, so that
+// Diff can tell what changed between them. Only the current version of each
+// team is stored with SetCacheFile, so older versions are lost on a restart.
+//
+// With SetCacheFile, the entries are also stored on disk. Entries loaded from
+// the file are served as stale until they have been updated.
+//
+// KeyPolicy is applied to the keys of all teams, unless there is an entry for
+// the team in TeamKeyPolicies. A nil policy allows all keys.
 type KeyCache struct {
-	cache        map[string]cacheEntry
-	collector    *KeyCollector
-	mutex        *sync.Mutex
-	organisation string
-	TTL          time.Duration
-	Updates      chan string
+	cache           map[string]cacheEntry
+	updates         map[string]*cacheUpdate
+	updatedTeams    map[string]bool
+	history         map[string][]keyVersion
+	servedAt        map[string]time.Time
+	source          KeySource
+	mutex           *sync.Mutex
+	file            *cacheFile
+	TTL             time.Duration
+	MaxStaleness    time.Duration
+	HistoryLength   int
+	KeyPolicy       *KeyPolicy
+	TeamKeyPolicies map[string]*KeyPolicy
+	Updates         chan string
+}
+
+// KeySet is the keys of a team, as served by a KeyCache, along with their
+// version and how long ago they were fetched from the source. JSON is the
+// encoded form of Users that is sent to HTTP clients.
+type KeySet struct {
+	Users   []UserInfo
+	JSON    []byte
+	Version uint64
+	Age     time.Duration
 }
 
+// cacheEntry holds the keys of a team. Version is the time the keys last
+// changed, in nanoseconds, so that it keeps increasing across restarts.
+// Restored is set for entries loaded from the cache file.
 type cacheEntry struct {
-	TeamID    int
+	Users     []UserInfo
 	JSON      []byte
 	UpdatedAt time.Time
+	Version   uint64
+	Restored  bool
 }
 
-// NewKeyCache creates a new Cache for the specified GitHub organisation, using
-// the provided GitHub access token and TTL.
-func NewKeyCache(githubOrg string, githubAccessToken string, ttl time.Duration) *KeyCache {
+func (e cacheEntry) keySet() KeySet {
+	return KeySet{
+		Users:   e.Users,
+		JSON:    e.JSON,
+		Version: e.Version,
+		Age:     time.Since(e.UpdatedAt),
+	}
+}
+
+// fresh returns whether the entry does not need to be updated yet.
+func (e cacheEntry) fresh(ttl time.Duration) bool {
+	return !e.Restored && time.Since(e.UpdatedAt) < ttl
+}
+
+// keyVersion is a version of the keys of a team in the history of the cache.
+type keyVersion struct {
+	Version uint64
+	Users   []UserInfo
+}
+
+// cacheUpdate is an update of a team that is in progress. done is closed once
+// it has finished, after which err holds its result.
+type cacheUpdate struct {
+	done chan struct{}
+	err  error
+}
+
+// NewKeyCache creates a new Cache for the provided KeySource and TTL.
+func NewKeyCache(source KeySource, ttl time.Duration) *KeyCache {
 	return &KeyCache{
-		cache:        map[string]cacheEntry{},
-		collector:    NewKeyCollector(githubAccessToken),
-		mutex:        &sync.Mutex{},
-		organisation: githubOrg,
-		TTL:          ttl,
-		Updates:      make(chan string, 5),
+		cache:         map[string]cacheEntry{},
+		updates:       map[string]*cacheUpdate{},
+		updatedTeams:  map[string]bool{},
+		history:       map[string][]keyVersion{},
+		servedAt:      map[string]time.Time{},
+		source:        source,
+		mutex:         &sync.Mutex{},
+		TTL:           ttl,
+		HistoryLength: defaultKeyCacheHistoryLength,
+		Updates:       make(chan string, 5),
+	}
+}
+
+// SetCacheFile makes the cache store its entries in the file at path, and
+// loads any entries that are already stored there. If the file cannot be
+// loaded, an error is returned, but the file is still used and its contents
+// are replaced on the next update.
+func (c *KeyCache) SetCacheFile(path string) error {
+	c.file = newCacheFile(path)
+
+	entries, err := c.file.load()
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	for team, entry := range entries {
+		c.cache[team] = entry
+		c.addVersion(team, entry)
 	}
+	c.mutex.Unlock()
+
+	simplelog.Infof("loaded keys for %d teams from '%s'", len(entries), path)
+
+	return nil
 }
 
 // Get returns the user SSH keys for the specified team. It will update if
-// there are no keys for this team in the cache or if they are older than
-// the Cache's TTL.
+// there are no keys for this team in the cache. If they are older than the
+// Cache's TTL, they are returned and updated in the background.
 func (c *KeyCache) Get(teamName string) ([]byte, error) {
-	if keys, exists := c.cache[teamName]; exists && time.Since(keys.UpdatedAt) < c.TTL {
-		simplelog.Debugf("found recent keys in the cache")
-		return keys.JSON, nil
+	set, err := c.GetKeySet(teamName)
+
+	return set.JSON, err
+}
+
+// GetKeySet is like Get, but also returns the version and age of the keys.
+func (c *KeyCache) GetKeySet(teamName string) (KeySet, error) {
+	if keys, exists := c.entry(teamName); exists {
+		c.markServed(teamName)
+
+		if keys.fresh(c.TTL) {
+			simplelog.Debugf("found recent keys in the cache")
+			return keys.keySet(), nil
+		}
+
+		simplelog.Debugf("keys in the cache are stale, updating in the background...")
+		c.updateInBackground(teamName)
+
+		return keys.keySet(), nil
 	}
 
 	simplelog.Debugf("keys not found in cache, updating...")
-	if err := c.updateSnippet(teamName); err != nil {
-		return nil, err
+	if err := c.update(teamName); err != nil {
+		return KeySet{}, err
 	}
 
-	return c.cache[teamName].JSON, nil
+	keys, _ := c.entry(teamName)
+	c.markServed(teamName)
+
+	return keys.keySet(), nil
 }
 
-func (c *KeyCache) updateSnippet(teamName string) error {
+// markServed records that the keys of the team were just served, so that
+// StaleTeams only reports teams whose keys are still in use.
+func (c *KeyCache) markServed(teamName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.servedAt[teamName] = time.Now()
+}
+
+// GetWithAge is like Get, but also returns how long ago the keys were
+// fetched from the source.
+//
+// Deprecated: use GetKeySet, which also returns the version of the keys.
+func (c *KeyCache) GetWithAge(teamName string) ([]byte, time.Duration, error) {
+	set, err := c.GetKeySet(teamName)
+
+	return set.JSON, set.Age, err
+}
+
+// Version returns the version of the keys of the team that are in the cache,
+// without updating them.
+func (c *KeyCache) Version(teamName string) (uint64, bool) {
+	keys, exists := c.entry(teamName)
+
+	return keys.Version, exists
+}
+
+// Diff returns the users and keys that were added and removed between two
+// versions of the keys of a team, without updating them. A zero to is the
+// current version, while a zero from is a version without any keys, so the
+// diff lists all the current keys as added. If either version is not in the
+// history, ErrKeyVersionNotFound is returned.
+func (c *KeyCache) Diff(teamName string, from uint64, to uint64) (KeyDiff, error) {
+	c.mutex.Lock()
+	history := c.history[teamName]
+	c.mutex.Unlock()
+
+	if len(history) == 0 {
+		return KeyDiff{}, ErrKeyVersionNotFound
+	}
+
+	if to == 0 {
+		to = history[len(history)-1].Version
+	}
+
+	fromUsers, toUsers := []UserInfo{}, []UserInfo{}
+	fromFound, toFound := from == 0, false
+	for _, v := range history {
+		if v.Version == from {
+			fromUsers, fromFound = v.Users, true
+		}
+
+		if v.Version == to {
+			toUsers, toFound = v.Users, true
+		}
+	}
+
+	if !fromFound || !toFound {
+		return KeyDiff{}, ErrKeyVersionNotFound
+	}
+
+	diff := DiffUserInfo(fromUsers, toUsers)
+	diff.From = from
+	diff.To = to
+
+	return diff, nil
+}
+
+// Teams returns the teams that have keys in the cache, in alphabetical order.
+func (c *KeyCache) Teams() []string {
+	c.mutex.Lock()
+	teams := make([]string, 0, len(c.cache))
+	for team := range c.cache {
+		teams = append(teams, team)
+	}
+	c.mutex.Unlock()
+
+	sort.Strings(teams)
+
+	return teams
+}
+
+// UpdatedTeams returns the teams whose keys have changed since it was last
+// called, in alphabetical order.
+func (c *KeyCache) UpdatedTeams() []string {
+	c.mutex.Lock()
+	teams := make([]string, 0, len(c.updatedTeams))
+	for team := range c.updatedTeams {
+		teams = append(teams, team)
+	}
+	c.updatedTeams = map[string]bool{}
+	c.mutex.Unlock()
+
+	sort.Strings(teams)
+
+	return teams
+}
+
+// StaleTeams returns the teams whose keys are older than MaxStaleness and have
+// been served within MaxStaleness, in alphabetical order.
+func (c *KeyCache) StaleTeams() []string {
+	stale := []string{}
+	if c.MaxStaleness <= 0 {
+		return stale
+	}
+
+	c.mutex.Lock()
+	for team, keys := range c.cache {
+		if time.Since(keys.UpdatedAt) > c.MaxStaleness && time.Since(c.servedAt[team]) <= c.MaxStaleness {
+			stale = append(stale, team)
+		}
+	}
+	c.mutex.Unlock()
+
+	sort.Strings(stale)
+
+	return stale
+}
+
+// entry returns the cache entry for the team.
+func (c *KeyCache) entry(teamName string) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys, exists := c.cache[teamName]
+
+	return keys, exists
+}
+
+// update updates the keys of the team, unless an update is already in
+// progress, in which case it waits for that update and returns its result.
+func (c *KeyCache) update(teamName string) error {
+	u, started := c.startUpdate(teamName)
+	if !started {
+		<-u.done
+		if u.err == nil {
+			simplelog.Debugf("keys are already up to date, won't update")
+		}
+
+		return u.err
+	}
+
+	c.finishUpdate(teamName, u)
+
+	return u.err
+}
+
+// updateInBackground starts updating the keys of the team without waiting
+// for the result, unless an update is already in progress.
+func (c *KeyCache) updateInBackground(teamName string) {
+	u, started := c.startUpdate(teamName)
+	if !started {
+		return
+	}
+
+	go func() {
+		c.finishUpdate(teamName, u)
+		if u.err != nil {
+			simplelog.Errorf("could not update keys for team '%s', serving stale keys: %v", teamName, u.err)
+		}
+	}()
+}
+
+// startUpdate returns the update of the team that is in progress, or
+// registers a new one, in which case started is true and the caller has to
+// run it with finishUpdate.
+func (c *KeyCache) startUpdate(teamName string) (u *cacheUpdate, started bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if _, exists := c.cache[teamName]; !exists {
-		c.cache[teamName] = cacheEntry{}
+	if u, exists := c.updates[teamName]; exists {
+		return u, false
 	}
 
-	keys := c.cache[teamName]
+	u = &cacheUpdate{done: make(chan struct{})}
+	c.updates[teamName] = u
+
+	return u, true
+}
+
+// finishUpdate runs an update registered by startUpdate and releases anyone
+// waiting for it. If the update panics, the waiters get an error and the
+// panic is passed on, so that the team can still be updated later.
+func (c *KeyCache) finishUpdate(teamName string, u *cacheUpdate) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			u.err = fmt.Errorf("update of team '%s' panicked: %v", teamName, r)
+		}
+
+		c.mutex.Lock()
+		delete(c.updates, teamName)
+		c.mutex.Unlock()
+		close(u.done)
+
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	u.err = c.updateSnippet(teamName)
+}
+
+// updateSnippet fetches the keys of the team from the source and stores them
+// in the cache. It must only be called through finishUpdate.
+func (c *KeyCache) updateSnippet(teamName string) error {
+	keys, existed := c.entry(teamName)
 
 	// it could be that this was updating while we were waiting to acquire a lock
-	if time.Since(keys.UpdatedAt) < c.TTL {
+	if keys.fresh(c.TTL) {
 		simplelog.Debugf("keys are already up to date, won't update")
 		return nil
 	}
 
-	if keys.TeamID == 0 {
-		id, err := c.collector.GetTeamID(c.organisation, teamName)
-		if err != nil {
-			return err
+	data, err := c.source.GetGroupMemberInfo(teamName, keys.Users)
+	if err == ErrTeamNotFound {
+		c.mutex.Lock()
+		delete(c.cache, teamName)
+		delete(c.history, teamName)
+		delete(c.servedAt, teamName)
+		if existed {
+			c.updatedTeams[teamName] = true
 		}
-		keys.TeamID = id
-	}
+		c.mutex.Unlock()
 
-	data, err := c.collector.GetTeamMemberInfo(keys.TeamID)
-	if err != nil {
+		if existed {
+			c.persist()
+		}
+
+		// clients that are waiting for the team have to learn that its keys
+		// are gone
+		if existed {
+			select {
+			case c.Updates <- teamName:
+			default:
+			}
+			simplelog.Debugf("sent the removal of team '%s' to the channel", teamName)
+		}
+
+		return err
+	} else if err != nil {
 		return err
 	}
 
+	data = c.keyPolicy(teamName).Apply(teamName, data)
+
 	previousKeysJSON := keys.JSON
 	jsonText, err := json.Marshal(map[string][]UserInfo{"keys": data})
 	if err != nil {
 		return err
 	}
 	keys.JSON = jsonText
+	keys.Users = data
 
 	keys.UpdatedAt = time.Now()
+	keys.Restored = false
 
+	changed := !bytes.Equal(previousKeysJSON, keys.JSON)
+	if changed {
+		version := uint64(keys.UpdatedAt.UnixNano())
+		if version <= keys.Version {
+			version = keys.Version + 1
+		}
+		keys.Version = version
+	}
+
+	c.mutex.Lock()
 	c.cache[teamName] = keys
+	if changed {
+		c.updatedTeams[teamName] = true
+		c.addVersion(teamName, keys)
+	}
+	c.mutex.Unlock()
+
+	// the cache file is only written when the keys change, instead of on
+	// every refresh of every team
+	if changed {
+		c.persist()
+	}
 
-	if !bytes.Equal(previousKeysJSON, keys.JSON) {
+	if changed {
+		// if the channel is full, the messages waiting to be read will pick
+		// this team up too through UpdatedTeams
 		select {
 		case c.Updates <- teamName:
-			simplelog.Debugf("sent an update for team '%s' to the channel", teamName)
 		default:
-			simplelog.Debugf("could not send an update to the channel")
 		}
+		simplelog.Debugf("sent an update for team '%s' to the channel", teamName)
 	} else {
 		simplelog.Debugf("keys have not changed, will not send an update")
 	}
 
 	return nil
 }
+
+// addVersion adds the keys of the entry to the history of the team, dropping
+// the oldest versions once there are more than HistoryLength. At least the
+// current version is always kept. The cache must be locked by the caller.
+func (c *KeyCache) addVersion(teamName string, keys cacheEntry) {
+	length := c.HistoryLength
+	if length < 1 {
+		length = 1
+	}
+
+	history := append(c.history[teamName], keyVersion{Version: keys.Version, Users: keys.Users})
+	if len(history) > length {
+		history = append([]keyVersion{}, history[len(history)-length:]...)
+	}
+
+	c.history[teamName] = history
+}
+
+// persist stores the entries of the cache in the cache file, if there is one.
+// Failing to do so is logged, since the cache can still be served from memory.
+func (c *KeyCache) persist() {
+	if c.file == nil {
+		return
+	}
+
+	// the file is locked first, so that an older snapshot of the cache is never
+	// written over a newer one
+	c.file.mutex.Lock()
+	defer c.file.mutex.Unlock()
+
+	c.mutex.Lock()
+	entries := make(map[string]cacheEntry, len(c.cache))
+	for team, keys := range c.cache {
+		entries[team] = keys
+	}
+	c.mutex.Unlock()
+
+	if err := c.file.save(entries); err != nil {
+		simplelog.Errorf("could not save the key cache to '%s': %v", c.file.path, err)
+	}
+}
+
+// keyPolicy returns the policy for the team. Team names are compared case
+// insensitively, since configuration keys are lowercased when they are read.
+func (c *KeyCache) keyPolicy(teamName string) *KeyPolicy {
+	if policy, exists := c.TeamKeyPolicies[teamName]; exists {
+		return policy
+	}
+
+	for team, policy := range c.TeamKeyPolicies {
+		if strings.EqualFold(team, teamName) {
+			return policy
+		}
+	}
+
+	return c.KeyPolicy
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,10 +27,9 @@ func TestKeyCache_Get_new(t *testing.T) {
 	mockInstallHandlers([]string{"orgTeams", "userKeys", "userInfo", "teamUserList"})
 	defer mockTeardown()
 
-	testKeyCache = NewKeyCache("none", "", 5*time.Second)
-	testKeyCache.collector = testKeyCollector
+	testKeyCache = NewKeyCache(NewGithubKeySource(testKeyCollector, "none", 5*time.Second), 5*time.Second)
 
-	dataExpected := []byte(`{"keys":[{"login":"user","id":999999,"name":"User Name","keys":"ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string"}]}`)
+	dataExpected := []byte(`{"keys":[{"login":"user","id":999999,"name":"User Name","keys":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/","public_keys":[{"type":"ssh-ed25519","bits":256,"fingerprint":"SHA256:f7tjoDWr4mjTalf8ewxa3DmBV48XxT+WjHTRElWWigY","key":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/"}]}]}`)
 
 	data, err := testKeyCache.Get("Owners")
 	if err != nil {
@@ -39,6 +41,478 @@ func TestKeyCache_Get_new(t *testing.T) {
 	}
 }
 
+// testKeySource is a KeySource that returns fixed data. Requests for a group
+// in blocked wait until its channel is closed.
+type testKeySource struct {
+	groups  map[string][]UserInfo
+	blocked map[string]chan struct{}
+	calls   int
+	mutex   sync.Mutex
+}
+
+func (s *testKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	s.mutex.Lock()
+	s.calls++
+	s.mutex.Unlock()
+
+	if wait, exists := s.blocked[groupName]; exists {
+		<-wait
+	}
+
+	s.mutex.Lock()
+	data, exists := s.groups[groupName]
+	s.mutex.Unlock()
+	if !exists {
+		return nil, ErrTeamNotFound
+	}
+
+	return data, nil
+}
+
+func TestKeyCache_Get_customSource(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	data, err := testKeyCache.Get("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	dataExpected := `{"keys":[{"login":"deploy-bot","id":1,"name":"Deploy Bot","keys":"` + testPublicKey + `","public_keys":[{"type":"ssh-ed25519","bits":256,"fingerprint":"` + testSSHKey.Fingerprint + `","key":"` + testPublicKey + `"}]}]}`
+	if string(data) != dataExpected {
+		t.Errorf("KeyCache.Get returned unexpected value: %s", data)
+	}
+
+	if _, err := testKeyCache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	if source.calls != 1 {
+		t.Errorf("KeyCache.Get should have used the cache, but the source was called %d times", source.calls)
+	}
+}
+
+func TestKeyCache_keyPolicy(t *testing.T) {
+	defaultPolicy := &KeyPolicy{MinRSABits: 2048}
+	teamPolicy := &KeyPolicy{MinRSABits: 4096}
+
+	cache := NewKeyCache(&testKeySource{}, time.Hour)
+	cache.KeyPolicy = defaultPolicy
+	// configuration keys are lowercased when they are read
+	cache.TeamKeyPolicies = map[string]*KeyPolicy{"platform-team": teamPolicy}
+
+	if policy := cache.keyPolicy("Platform-Team"); policy != teamPolicy {
+		t.Errorf("KeyCache.keyPolicy did not match the team policy case insensitively: %v", policy)
+	}
+
+	if policy := cache.keyPolicy("other"); policy != defaultPolicy {
+		t.Errorf("KeyCache.keyPolicy returned unexpected policy for a team without one: %v", policy)
+	}
+}
+
+func TestKeyCache_keyPolicy_merge(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"platform": []UserInfo{
+				UserInfo{Login: "user00", ID: 999998, Name: "User Zero", Keys: []SSHKey{testSSHKeyRSA}},
+				UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKey, testSSHKeyRSA}},
+			},
+			"oncall": []UserInfo{
+				UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKey, testSSHKeyRSA}},
+			},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	cache.TeamKeyPolicies = map[string]*KeyPolicy{
+		"platform": &KeyPolicy{AllowedKeyTypes: []string{"ed25519"}},
+		"oncall":   &KeyPolicy{AllowedKeyTypes: []string{"rsa"}},
+	}
+
+	sets := [][]UserInfo{}
+	for _, team := range []string{"platform", "oncall"} {
+		set, err := cache.GetKeySet(team)
+		if err != nil {
+			t.Fatalf("KeyCache.GetKeySet returned an error for team '%s': %v", team, err)
+		}
+		sets = append(sets, set.Users)
+	}
+
+	// user00 has no keys that are allowed in platform, while the keys of
+	// user01 are allowed by one team each
+	expected := []UserInfo{
+		UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKey, testSSHKeyRSA}},
+	}
+
+	if merged := MergeUserInfo(sets...); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("MergeUserInfo returned unexpected value for teams with different key policies: %v", merged)
+	}
+}
+
+func TestKeyCache_Get_teamDeleted(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"Owners": []UserInfo{UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	if _, err := testKeyCache.Get("Owners"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	delete(source.groups, "Owners")
+	entry := testKeyCache.cache["Owners"]
+	entry.UpdatedAt = time.Time{}
+	testKeyCache.cache["Owners"] = entry
+
+	// the stale keys are served while the team is updated in the background
+	if _, err := testKeyCache.Get("Owners"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error for stale keys: %v", err)
+	}
+
+	if err := testKeyCache.update("Owners"); err != ErrTeamNotFound {
+		t.Fatalf("KeyCache.update should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+
+	if _, exists := testKeyCache.entry("Owners"); exists {
+		t.Errorf("KeyCache.Get did not remove the entry of a deleted team")
+	}
+
+	if teams := testKeyCache.UpdatedTeams(); !reflect.DeepEqual(teams, []string{"Owners"}) {
+		t.Errorf("KeyCache.UpdatedTeams did not return the deleted team: %v", teams)
+	}
+
+	if _, err := testKeyCache.Get("Owners"); err != ErrTeamNotFound {
+		t.Fatalf("KeyCache.Get should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
+
+func TestKeyCache_Get_stale(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	staleData, err := testKeyCache.Get("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	entry := testKeyCache.cache["deploy"]
+	entry.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	testKeyCache.cache["deploy"] = entry
+
+	// the source will block until the stale keys have been served
+	source.groups["deploy"] = []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot v2", Keys: []SSHKey{testSSHKey}}}
+	source.blocked = map[string]chan struct{}{"deploy": make(chan struct{})}
+
+	set, err := testKeyCache.GetKeySet("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.GetKeySet returned an error: %v", err)
+	}
+
+	if !bytes.Equal(set.JSON, staleData) {
+		t.Errorf("KeyCache.GetKeySet did not return the stale keys: %s", set.JSON)
+	}
+
+	if set.Age < 2*time.Hour {
+		t.Errorf("KeyCache.GetKeySet returned an unexpected age for stale keys: %v", set.Age)
+	}
+	staleVersion := set.Version
+
+	close(source.blocked["deploy"])
+	if err := testKeyCache.update("deploy"); err != nil {
+		t.Fatalf("KeyCache.update returned an error: %v", err)
+	}
+
+	set, err = testKeyCache.GetKeySet("deploy")
+	if err != nil {
+		t.Fatalf("KeyCache.GetKeySet returned an error: %v", err)
+	}
+
+	if !bytes.Contains(set.JSON, []byte("Deploy Bot v2")) || set.Age > time.Minute {
+		t.Errorf("KeyCache.GetKeySet did not return the updated keys: %s, %v", set.JSON, set.Age)
+	}
+
+	if set.Version <= staleVersion {
+		t.Errorf("KeyCache.GetKeySet did not increase the version of updated keys: %d, was %d", set.Version, staleVersion)
+	}
+
+	if teams := testKeyCache.UpdatedTeams(); len(teams) != 1 || teams[0] != "deploy" {
+		t.Errorf("KeyCache.UpdatedTeams returned unexpected teams: %v", teams)
+	}
+
+	if source.calls != 2 {
+		t.Errorf("KeyCache should have updated the stale keys once, but the source was called %d times", source.calls)
+	}
+}
+
+func TestKeyCache_StaleTeams(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+		blocked: map[string]chan struct{}{},
+	}
+
+	testKeyCache = NewKeyCache(source, time.Minute)
+	testKeyCache.MaxStaleness = time.Hour
+
+	if _, err := testKeyCache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	// keys that nobody has asked for in a while are not being served, so
+	// they do not count as stale
+	testKeyCache.mutex.Lock()
+	entry := testKeyCache.cache["deploy"]
+	entry.UpdatedAt = time.Now().Add(-90 * time.Minute)
+	testKeyCache.cache["deploy"] = entry
+	testKeyCache.servedAt["deploy"] = time.Now().Add(-90 * time.Minute)
+	testKeyCache.mutex.Unlock()
+
+	if teams := testKeyCache.StaleTeams(); len(teams) != 0 {
+		t.Errorf("KeyCache.StaleTeams returned teams that are not being served: %v", teams)
+	}
+
+	// keep the background update from refreshing the keys
+	source.blocked["deploy"] = make(chan struct{})
+	defer func() {
+		close(source.blocked["deploy"])
+		testKeyCache.update("deploy")
+	}()
+
+	if _, err := testKeyCache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	if teams := testKeyCache.StaleTeams(); len(teams) != 1 || teams[0] != "deploy" {
+		t.Errorf("KeyCache.StaleTeams returned unexpected teams: %v", teams)
+	}
+
+	// teams that do not exist are never served
+	if _, err := testKeyCache.Get("missing"); err != ErrTeamNotFound {
+		t.Fatalf("KeyCache.Get returned unexpected error for a missing team: %v", err)
+	}
+
+	testKeyCache.mutex.Lock()
+	_, served := testKeyCache.servedAt["missing"]
+	testKeyCache.mutex.Unlock()
+	if served {
+		t.Errorf("KeyCache.Get recorded a team that does not exist as served")
+	}
+}
+
+func TestKeyCache_Get_concurrent(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"slow": []UserInfo{UserInfo{Login: "user", ID: 1, Name: "User", Keys: []SSHKey{testSSHKey}}},
+			"fast": []UserInfo{UserInfo{Login: "deploy-bot", ID: 2, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+		blocked: map[string]chan struct{}{"slow": make(chan struct{})},
+	}
+
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := testKeyCache.Get("slow"); err != nil {
+				t.Errorf("KeyCache.Get returned an error: %v", err)
+			}
+		}()
+	}
+
+	// the slow team is still being updated, which should not block others
+	fast := make(chan error)
+	go func() {
+		_, err := testKeyCache.Get("fast")
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Errorf("KeyCache.Get returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeyCache.Get for a team was blocked by the update of another team")
+	}
+
+	close(source.blocked["slow"])
+	wg.Wait()
+
+	// one update for the fast team and one shared by all slow team requests
+	if source.calls != 2 {
+		t.Errorf("KeyCache.Get should have coalesced the updates, but the source was called %d times", source.calls)
+	}
+}
+
+// testPanicKeySource is a KeySource that panics once its channel is closed.
+type testPanicKeySource struct {
+	wait chan struct{}
+}
+
+func (s testPanicKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	<-s.wait
+	panic("broken source")
+}
+
+func TestKeyCache_Get_panic(t *testing.T) {
+	source := testPanicKeySource{wait: make(chan struct{})}
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		testKeyCache.Get("deploy")
+	}()
+
+	// wait for the update of the first request and join it, like a concurrent
+	// request would
+	for {
+		testKeyCache.mutex.Lock()
+		_, updating := testKeyCache.updates["deploy"]
+		testKeyCache.mutex.Unlock()
+		if updating {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	u, started := testKeyCache.startUpdate("deploy")
+	if started {
+		t.Fatal("KeyCache started a second update for the same team")
+	}
+
+	close(source.wait)
+
+	if r := <-panicked; r == nil {
+		t.Error("KeyCache.Get should have passed on the panic of the update")
+	}
+
+	select {
+	case <-u.done:
+		if u.err == nil {
+			t.Error("KeyCache should have set an error for a panicked update")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeyCache did not release the waiters of a panicked update")
+	}
+
+	testKeyCache.mutex.Lock()
+	defer testKeyCache.mutex.Unlock()
+	if _, exists := testKeyCache.updates["deploy"]; exists {
+		t.Error("KeyCache kept the panicked update in progress")
+	}
+}
+
+func TestKeyCache_UpdatedTeams(t *testing.T) {
+	source := &testKeySource{groups: map[string][]UserInfo{}}
+	teamsExpected := []string{}
+	for i := 0; i < 10; i++ {
+		team := fmt.Sprintf("team%d", i)
+		source.groups[team] = []UserInfo{UserInfo{Login: "user", ID: 1, Name: "User", Keys: []SSHKey{testSSHKey}}}
+		teamsExpected = append(teamsExpected, team)
+	}
+
+	testKeyCache = NewKeyCache(source, time.Hour)
+
+	// nobody is reading the channel, but no update should be lost
+	for _, team := range teamsExpected {
+		if _, err := testKeyCache.Get(team); err != nil {
+			t.Fatalf("KeyCache.Get returned an error: %v", err)
+		}
+	}
+
+	select {
+	case team := <-testKeyCache.Updates:
+		if team != teamsExpected[0] {
+			t.Errorf("KeyCache sent an unexpected team on the channel: %s", team)
+		}
+	default:
+		t.Error("KeyCache did not signal the updates on the channel")
+	}
+
+	if teams := testKeyCache.UpdatedTeams(); !reflect.DeepEqual(teams, teamsExpected) {
+		t.Errorf("KeyCache.UpdatedTeams returned unexpected teams: %v", teams)
+	}
+
+	if teams := testKeyCache.UpdatedTeams(); len(teams) != 0 {
+		t.Errorf("KeyCache.UpdatedTeams returned teams that were already returned: %v", teams)
+	}
+}
+
+func TestKeyCache_Diff(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "alice", ID: 1, Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	cache.HistoryLength = 2
+
+	versions := []uint64{}
+	for _, users := range [][]UserInfo{
+		source.groups["deploy"],
+		[]UserInfo{UserInfo{Login: "alice", ID: 1, Keys: []SSHKey{testSSHKey, testSSHKeyRSA}}},
+		[]UserInfo{UserInfo{Login: "bob", ID: 2, Keys: []SSHKey{testSSHKey}}},
+	} {
+		testChangeUsers(t, cache, source, "deploy", users)
+
+		version, _ := cache.Version("deploy")
+		versions = append(versions, version)
+	}
+
+	diff, err := cache.Diff("deploy", versions[1], 0)
+	if err != nil {
+		t.Fatalf("KeyCache.Diff returned an error: %v", err)
+	}
+
+	expected := KeyDiff{
+		From:         versions[1],
+		To:           versions[2],
+		AddedUsers:   []DiffUser{DiffUser{Login: "bob"}},
+		RemovedUsers: []DiffUser{DiffUser{Login: "alice"}},
+		AddedKeys:    []UserKey{UserKey{Login: "bob", Type: testSSHKey.Type, Fingerprint: testSSHKey.Fingerprint}},
+		RemovedKeys: []UserKey{
+			UserKey{Login: "alice", Type: testSSHKey.Type, Fingerprint: testSSHKey.Fingerprint},
+			UserKey{Login: "alice", Type: testSSHKeyRSA.Type, Fingerprint: testSSHKeyRSA.Fingerprint},
+		},
+	}
+
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("KeyCache.Diff returned unexpected diff: %+v", diff)
+	}
+
+	if diff, err := cache.Diff("deploy", 0, versions[1]); err != nil || len(diff.AddedKeys) != 2 || len(diff.RemovedKeys) != 0 {
+		t.Errorf("KeyCache.Diff returned unexpected diff from an empty version: %+v %v", diff, err)
+	}
+
+	// the first version has been dropped from the history
+	if _, err := cache.Diff("deploy", versions[0], 0); err != ErrKeyVersionNotFound {
+		t.Errorf("KeyCache.Diff returned unexpected error for a dropped version: %v", err)
+	}
+
+	if _, err := cache.Diff("missing", 0, 0); err != ErrKeyVersionNotFound {
+		t.Errorf("KeyCache.Diff returned unexpected error for a missing team: %v", err)
+	}
+}
+
 func ExampleKeyCache_Get_twice() {
 	simplelog.MockClock(true)
 	defer simplelog.MockClock(false)
@@ -47,8 +521,7 @@ func ExampleKeyCache_Get_twice() {
 	mockInstallHandlers([]string{"orgTeams", "userKeys", "userInfo", "teamUserList"})
 	defer mockTeardown()
 
-	testKeyCache = NewKeyCache("none", "", 5*time.Second)
-	testKeyCache.collector = testKeyCollector
+	testKeyCache = NewKeyCache(NewGithubKeySource(testKeyCollector, "none", 5*time.Second), 5*time.Second)
 
 	_, err := testKeyCache.Get("Owners")
 	if err != nil {
@@ -84,8 +557,7 @@ func ExampleKeyCache_Get_late() {
 	})
 	defer mockTeardown()
 
-	testKeyCache = NewKeyCache("none", "", 5*time.Second)
-	testKeyCache.collector = testKeyCollector
+	testKeyCache = NewKeyCache(NewGithubKeySource(testKeyCollector, "none", 5*time.Second), 5*time.Second)
 
 	go func() {
 		_, err := testKeyCache.Get("Owners")
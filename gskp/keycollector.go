@@ -1,11 +1,18 @@
 package gskp
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
@@ -21,16 +28,191 @@ var (
 	// the organization's teams.
 	ErrTeamNotFound = errors.New("Team was not found in the organization")
 
+	// ErrInvalidCABundle is returned when a CA bundle does not contain any
+	// PEM encoded certificates.
+	ErrInvalidCABundle = errors.New("CA bundle does not contain any valid certificates")
+
 	defaultGithubKeysURL = "https://github.com/%s.keys"
+
+	// defaultMemberFetchConcurrency is how many team members are fetched in
+	// parallel by default.
+	defaultMemberFetchConcurrency = 10
+
+	// defaultMemberFetchTimeout is how long to wait for the profile and keys
+	// of a single team member by default.
+	defaultMemberFetchTimeout = 30 * time.Second
+
+	// githubNestedTeamsMediaType is required by the GitHub API to list the
+	// child teams of a team.
+	githubNestedTeamsMediaType = "application/vnd.github.hellcat-preview+json"
 )
 
 // UserInfo is a struct that contains information about a GitHub user,
-// including Login Name and SSH Keys.
+// including Login Name and SSH Keys. GrantedBy is only set when child teams
+// are resolved and holds the team through which the user was granted access.
+// Stale is set when the keys could not be fetched and the last known keys
+// are used instead. RejectedKeys holds the keys that were not allowed by the
+// KeyPolicy. Source is the key source the user comes from, which is empty for
+// GitHub. IDs are only unique within a source.
 type UserInfo struct {
-	Login string `json:"login"`
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Keys  string `json:"keys"`
+	Login        string
+	ID           int
+	Source       string
+	Name         string
+	Keys         []SSHKey
+	RejectedKeys []RejectedSSHKey
+	GrantedBy    string
+	Stale        bool
+}
+
+// userInfoJSON is the serialised form of UserInfo. LegacyKeys holds the keys
+// as a single newline separated string, which is the format older agents
+// expect.
+type userInfoJSON struct {
+	Login        string           `json:"login"`
+	ID           int              `json:"id"`
+	Source       string           `json:"source,omitempty"`
+	Name         string           `json:"name"`
+	LegacyKeys   string           `json:"keys"`
+	Keys         []SSHKey         `json:"public_keys"`
+	RejectedKeys []RejectedSSHKey `json:"rejected_keys,omitempty"`
+	GrantedBy    string           `json:"granted_by,omitempty"`
+	Stale        bool             `json:"stale,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Both the structured keys and the
+// legacy keys string are included in the output.
+func (ui UserInfo) MarshalJSON() ([]byte, error) {
+	keys := ui.Keys
+	if keys == nil {
+		keys = []SSHKey{}
+	}
+
+	return json.Marshal(userInfoJSON{
+		Login:        ui.Login,
+		ID:           ui.ID,
+		Source:       ui.Source,
+		Name:         ui.Name,
+		LegacyKeys:   joinSSHKeys(keys),
+		Keys:         keys,
+		RejectedKeys: ui.RejectedKeys,
+		GrantedBy:    ui.GrantedBy,
+		Stale:        ui.Stale,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. If the structured keys are
+// missing, as they will be when talking to an older collector, the legacy
+// keys string is parsed instead.
+func (ui *UserInfo) UnmarshalJSON(data []byte) error {
+	var uij userInfoJSON
+	if err := json.Unmarshal(data, &uij); err != nil {
+		return err
+	}
+
+	keys := uij.Keys
+	if keys == nil {
+		keys, _ = ParseSSHKeys(uij.LegacyKeys)
+	}
+
+	*ui = UserInfo{
+		Login:        uij.Login,
+		ID:           uij.ID,
+		Source:       uij.Source,
+		Name:         uij.Name,
+		Keys:         keys,
+		RejectedKeys: uij.RejectedKeys,
+		GrantedBy:    uij.GrantedBy,
+		Stale:        uij.Stale,
+	}
+
+	return nil
+}
+
+// userIdentity identifies a user across key sources, whose IDs can overlap.
+type userIdentity struct {
+	Source string
+	ID     int
+}
+
+func (ui UserInfo) identity() userIdentity {
+	return userIdentity{Source: ui.Source, ID: ui.ID}
+}
+
+// MergeUserInfo combines several lists of UserInfo structs into one,
+// de-duplicating users by their source and ID. Users are kept in the order
+// they are first seen. The keys of a user are combined across the lists, since
+// each list can have its own key policy, and keys are de-duplicated by their
+// fingerprint. A key that is accepted in one list is not reported as rejected.
+func MergeUserInfo(sets ...[]UserInfo) []UserInfo {
+	merged := []UserInfo{}
+	positions := map[userIdentity]int{}
+
+	for _, set := range sets {
+		for _, ui := range set {
+			i, seen := positions[ui.identity()]
+			if !seen {
+				ui.Keys = mergeSSHKeys(nil, ui.Keys)
+				positions[ui.identity()] = len(merged)
+				merged = append(merged, ui)
+				continue
+			}
+
+			merged[i].Keys = mergeSSHKeys(merged[i].Keys, ui.Keys)
+			if len(ui.RejectedKeys) > 0 {
+				merged[i].RejectedKeys = append(append([]RejectedSSHKey{}, merged[i].RejectedKeys...), ui.RejectedKeys...)
+			}
+		}
+	}
+
+	for i, ui := range merged {
+		if len(ui.RejectedKeys) == 0 {
+			continue
+		}
+
+		seen := map[string]bool{}
+		for _, key := range ui.Keys {
+			seen[key.Fingerprint] = true
+		}
+
+		var rejected []RejectedSSHKey
+		for _, key := range ui.RejectedKeys {
+			if seen[key.Fingerprint] {
+				continue
+			}
+
+			seen[key.Fingerprint] = true
+			rejected = append(rejected, key)
+		}
+		merged[i].RejectedKeys = rejected
+	}
+
+	return merged
+}
+
+// mergeSSHKeys returns a new slice with the keys that are in a, followed by
+// the keys of b whose fingerprint is not already in it.
+func mergeSSHKeys(a []SSHKey, b []SSHKey) []SSHKey {
+	if a == nil && b == nil {
+		return nil
+	}
+
+	ret := append([]SSHKey{}, a...)
+	seen := map[string]bool{}
+	for _, key := range a {
+		seen[key.Fingerprint] = true
+	}
+
+	for _, key := range b {
+		if seen[key.Fingerprint] {
+			continue
+		}
+
+		seen[key.Fingerprint] = true
+		ret = append(ret, key)
+	}
+
+	return ret
 }
 
 // KeyCollector fetches user information and their public SSH keys from GitHub.
@@ -38,48 +220,332 @@ type KeyCollector struct {
 	githubClient  *github.Client
 	httpClient    *http.Client
 	githubKeysURL string
+	rateLimiter   *rateLimiter
+	httpCache     *httpCache
+	profiles      *profileCache
+	concurrency   int
+	memberTimeout time.Duration
 }
 
-// NewKeyCollector returns an instantiated KeyCollector.
+// NewKeyCollector returns an instantiated KeyCollector, which will use the
+// provided personal access token.
 func NewKeyCollector(githubAccessToken string) *KeyCollector {
-	tc := oauth2.NewClient(
-		oauth2.NoContext,
+	return NewKeyCollectorWithTokenSource(
 		oauth2.StaticTokenSource(
 			&oauth2.Token{AccessToken: githubAccessToken},
 		),
 	)
+}
+
+// NewKeyCollectorWithTokenSource returns an instantiated KeyCollector, which
+// will get access tokens from the provided oauth2.TokenSource. This can be
+// used with NewGithubAppTokenSource to authenticate as a GitHub App.
+func NewKeyCollectorWithTokenSource(tokenSource oauth2.TokenSource) *KeyCollector {
+	// the default endpoints are always valid, so this cannot fail
+	k, _ := NewEnterpriseKeyCollector(tokenSource, GithubEndpoints{})
+
+	return k
+}
+
+// GithubEndpoints holds the URLs used to talk to GitHub, which only need to
+// be set for GitHub Enterprise Server. BaseURL is the API URL (eg.
+// "https://github.example.com/api/v3/") and UploadURL the uploads API URL (eg.
+// "https://github.example.com/api/uploads/"). KeysURL is a template for the
+// URL of the public keys of a user, where %s is replaced with the login (eg.
+// "https://github.example.com/%s.keys"). CABundle holds PEM encoded
+// certificates which are trusted in addition to the system ones.
+type GithubEndpoints struct {
+	BaseURL   string
+	UploadURL string
+	KeysURL   string
+	CABundle  []byte
+}
+
+// NewEnterpriseKeyCollector returns an instantiated KeyCollector, which will
+// talk to GitHub using the provided endpoints and get access tokens from the
+// provided oauth2.TokenSource. Any empty endpoints default to the public
+// GitHub ones. If a BaseURL is set but no KeysURL, the keys URL is derived
+// from the BaseURL by dropping the "api/v3/" path.
+func NewEnterpriseKeyCollector(tokenSource oauth2.TokenSource, endpoints GithubEndpoints) (*KeyCollector, error) {
+	httpClient, err := NewGithubHTTPClient(endpoints.CABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	// the rate limiter wraps the cache, so that it sees the rate limit headers
+	// of 304 responses too
+	cache := newHTTPCache(httpClient.Transport)
+	rl := newRateLimiter(cache)
+
+	tc := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: tokenSource,
+			Base:   rl,
+		},
+	}
+
+	githubClient := github.NewClient(tc)
+
+	if endpoints.BaseURL != "" {
+		if githubClient.BaseURL, err = parseGithubURL(endpoints.BaseURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if endpoints.UploadURL != "" {
+		if githubClient.UploadURL, err = parseGithubURL(endpoints.UploadURL); err != nil {
+			return nil, err
+		}
+	}
+
+	keysURL := endpoints.KeysURL
+	if keysURL == "" && endpoints.BaseURL != "" {
+		keysURL = strings.TrimSuffix(githubClient.BaseURL.String(), "api/v3/") + "%s.keys"
+	} else if keysURL == "" {
+		keysURL = defaultGithubKeysURL
+	}
+
+	if strings.Count(keysURL, "%s") != 1 || strings.Count(keysURL, "%") != 1 {
+		return nil, fmt.Errorf("GitHub keys URL '%s' must contain exactly one %%s and no other verbs", keysURL)
+	}
 
 	return &KeyCollector{
-		githubClient:  github.NewClient(tc),
-		httpClient:    &http.Client{},
-		githubKeysURL: defaultGithubKeysURL,
+		githubClient:  githubClient,
+		httpClient:    &http.Client{Transport: cache},
+		githubKeysURL: keysURL,
+		rateLimiter:   rl,
+		httpCache:     cache,
+		profiles:      newProfileCache(defaultProfileCacheTTL),
+		concurrency:   defaultMemberFetchConcurrency,
+		memberTimeout: defaultMemberFetchTimeout,
+	}, nil
+}
+
+// NewGithubHTTPClient returns an http.Client which trusts the certificates in
+// the PEM encoded caBundle, in addition to the system ones. If caBundle is
+// empty, only the system certificates are trusted.
+func NewGithubHTTPClient(caBundle []byte) (*http.Client, error) {
+	if len(caBundle) == 0 {
+		return &http.Client{Transport: http.DefaultTransport}, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, ErrInvalidCABundle
 	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     &tls.Config{RootCAs: pool},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}, nil
 }
 
-// GetTeamID finds the GitHub team id, based on the organization and team
-// names.
-func (k *KeyCollector) GetTeamID(organizationName string, teamName string) (int, error) {
-	simplelog.Debugf("Fetching list of teams for organization '%s'", organizationName)
+// parseGithubURL parses a GitHub API URL, making sure that it has a trailing
+// slash as the GitHub client requires.
+func parseGithubURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("GitHub URL '%s' must be absolute", rawURL)
+	}
+
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	return u, nil
+}
+
+// RateLimit returns the last known state of the GitHub API rate limit.
+func (k *KeyCollector) RateLimit() RateLimitStatus {
+	if k.rateLimiter == nil {
+		return RateLimitStatus{}
+	}
+
+	return k.rateLimiter.Status()
+}
+
+// HTTPCacheStats returns the hit and miss counts of the cache for conditional
+// requests to GitHub.
+func (k *KeyCollector) HTTPCacheStats() HTTPCacheStats {
+	if k.httpCache == nil {
+		return HTTPCacheStats{}
+	}
+
+	return k.httpCache.Stats()
+}
+
+// SetMemberFetchConcurrency sets how many team members have their profile and
+// keys fetched in parallel, and how long to wait for a single member before
+// falling back to their last known keys. A timeout of 0 waits indefinitely.
+// It should be called before the KeyCollector is used.
+func (k *KeyCollector) SetMemberFetchConcurrency(workers int, timeout time.Duration) {
+	k.concurrency = workers
+	k.memberTimeout = timeout
+}
+
+// SetProfileCacheTTL sets how long the profiles of users, which provide their
+// display names, are cached for. Team membership and keys are not affected.
+func (k *KeyCollector) SetProfileCacheTTL(ttl time.Duration) {
+	k.profiles.SetTTL(ttl)
+}
+
+// SetRateLimitPolicy sets the fraction of the GitHub API rate limit that is
+// kept in reserve and the longest a request will wait for the rate limit to
+// reset before failing.
+func (k *KeyCollector) SetRateLimitPolicy(reserve float64, maxWait time.Duration) {
+	if k.rateLimiter != nil {
+		k.rateLimiter.SetPolicy(reserve, maxWait)
+	}
+}
 
-	orgTeams, _, err := k.githubClient.Organizations.ListTeams(organizationName, nil)
+// GetTeamID finds the GitHub team id, based on the organization name and the
+// team slug or name.
+func (k *KeyCollector) GetTeamID(organizationName string, teamName string) (int, error) {
+	teamIndex, err := k.GetTeamIndex(organizationName)
 	if err != nil {
 		return -1, err
 	}
 
+	id, exists := teamIndex[teamName]
+	if !exists {
+		return -1, ErrTeamNotFound
+	}
+
+	simplelog.Debugf("Team '%s' with id %d found in organization '%s'", teamName, id, organizationName)
+
+	return id, nil
+}
+
+// GetTeamIndex returns a map of team slugs and names to team IDs, for all the
+// teams in the organization. Slugs take precedence over names, so a team
+// cannot be shadowed by another team that uses its slug as a display name.
+func (k *KeyCollector) GetTeamIndex(organizationName string) (map[string]int, error) {
+	simplelog.Debugf("Fetching list of teams for organization '%s'", organizationName)
+
+	orgTeams := []*github.Team{}
+
+	ltOpts := &github.ListOptions{
+		Page:    0,
+		PerPage: 100,
+	}
+
+	for {
+		teams, resp, err := k.githubClient.Organizations.ListTeams(organizationName, ltOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		orgTeams = append(orgTeams, teams...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		ltOpts.Page = resp.NextPage
+	}
+
+	teamIndex := map[string]int{}
+
+	for _, team := range orgTeams {
+		if team.Slug != nil && *team.Slug != "" {
+			teamIndex[*team.Slug] = *team.ID
+		}
+	}
+
 	for _, team := range orgTeams {
-		if *team.Name == teamName {
-			simplelog.Debugf("Team '%s' with id %d found in organization '%s'", teamName, *team.ID, organizationName)
+		if team.Name == nil {
+			continue
+		}
 
-			return *team.ID, nil
+		if _, exists := teamIndex[*team.Name]; !exists {
+			teamIndex[*team.Name] = *team.ID
 		}
 	}
 
-	return -1, ErrTeamNotFound
+	return teamIndex, nil
 }
 
 // GetTeamMemberInfo returns a slice of UserInfo structs, which contains
 // information on the users that belong to the specified GitHub team.
-func (k *KeyCollector) GetTeamMemberInfo(teamID int) ([]UserInfo, error) {
+//
+// lastKnown can hold the previously collected information for the team. If
+// the keys of a member cannot be fetched, their last known keys will be used
+// and the entry will be marked as stale, instead of dropping the member.
+func (k *KeyCollector) GetTeamMemberInfo(teamID int, lastKnown []UserInfo) ([]UserInfo, error) {
+	return k.getTeamMemberInfo(teamID, map[int]bool{}, indexUserInfo(lastKnown))
+}
+
+// GetNestedTeamMemberInfo works like GetTeamMemberInfo, but it will also walk
+// through all the child teams of the specified team and include their members.
+// Each user is only included once and the GrantedBy field is set to the most
+// specific team they belong to. GitHub lists the members of child teams as
+// members of their parents too, so the child teams are processed first.
+func (k *KeyCollector) GetNestedTeamMemberInfo(teamID int, lastKnown []UserInfo) ([]UserInfo, error) {
+	simplelog.Debugf("Fetching details for team with ID %d", teamID)
+
+	team, _, err := k.githubClient.Organizations.GetTeam(teamID)
+	if err != nil {
+		return nil, err
+	}
+
+	// walk the team tree first, so that every team comes after its parent
+	teams := []*github.Team{team}
+	seenTeams := map[int]bool{teamID: true}
+
+	for i := 0; i < len(teams); i++ {
+		childTeams, err := k.getChildTeams(*teams[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ct := range childTeams {
+			if seenTeams[*ct.ID] {
+				continue
+			}
+
+			seenTeams[*ct.ID] = true
+			teams = append(teams, ct)
+		}
+	}
+
+	teamMemberInfo := make([][]UserInfo, len(teams))
+	seenUsers := map[int]bool{}
+	lastKnownByID := indexUserInfo(lastKnown)
+
+	for i := len(teams) - 1; i >= 0; i-- {
+		teamMemberInfo[i], err = k.getTeamMemberInfo(*teams[i].ID, seenUsers, lastKnownByID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	memberInfo := []UserInfo{}
+	for i, t := range teams {
+		for _, ui := range teamMemberInfo[i] {
+			ui.GrantedBy = teamIdentifier(t)
+			memberInfo = append(memberInfo, ui)
+		}
+	}
+
+	return memberInfo, nil
+}
+
+// getTeamMemberInfo collects the UserInfo for the members of the specified
+// team, skipping any user that is already in seenUsers. Every user that is
+// processed is added to seenUsers. Users whose keys cannot be fetched fall
+// back to their entry in lastKnown.
+func (k *KeyCollector) getTeamMemberInfo(teamID int, seenUsers map[int]bool, lastKnown map[int]UserInfo) ([]UserInfo, error) {
 	memberInfo := []UserInfo{}
 
 	ltmOpts := &github.OrganizationListTeamMembersOptions{
@@ -98,66 +564,252 @@ func (k *KeyCollector) GetTeamMemberInfo(teamID int) ([]UserInfo, error) {
 			return nil, err
 		}
 
+		newMembers := []*github.User{}
 		for _, tm := range teamMembers {
-			ui := UserInfo{
-				Login: *tm.Login,
-				ID:    *tm.ID,
-				Name:  "unknown name",
-				Keys:  "",
+			if seenUsers[*tm.ID] {
+				simplelog.Debugf("User '%s' has already been processed, skipping", *tm.Login)
+				continue
 			}
+			seenUsers[*tm.ID] = true
 
-			user, _, err := k.githubClient.Users.GetByID(*tm.ID)
-			if err != nil {
-				simplelog.Infof("Could not fetch details for user '%s': %v", *tm.Login, err)
-			} else if user.Name != nil {
-				ui.Name = *user.Name
-			}
-
-			keys, err := k.getUserKeys(*tm.Login)
-			if err != nil {
-				simplelog.Infof("Could not fetch keys for user '%s': %v", *tm.Login, err)
-			} else {
-				ui.Keys = keys
-			}
-
-			if ui.Keys == "" {
-				simplelog.Infof("No public SSH keys for user '%s'", *tm.Login)
-			} else {
-				memberInfo = append(memberInfo, ui)
-			}
+			newMembers = append(newMembers, tm)
 		}
 
+		memberInfo = append(memberInfo, k.getMembersInfo(newMembers, lastKnown)...)
+
 		if resp.NextPage == 0 {
 			simplelog.Debugf("GitHub API Limits: %d / %d until %s", resp.Remaining, resp.Limit, resp.Reset)
 
 			break
 		}
+
+		ltmOpts.Page = resp.NextPage
 	}
 
 	return memberInfo, nil
 }
 
-func (k *KeyCollector) getUserKeys(userLogin string) (string, error) {
+// getMembersInfo fetches the profiles and keys of the members, using up to
+// k.concurrency requests in parallel. The results are in the same order as
+// the members. Members without any keys are left out.
+func (k *KeyCollector) getMembersInfo(members []*github.User, lastKnown map[int]UserInfo) []UserInfo {
+	results := make([]*UserInfo, len(members))
+
+	workers := k.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(members) {
+		workers = len(members)
+	}
+
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				results[i] = k.getMemberInfo(members[i], lastKnown)
+			}
+		}()
+	}
+
+	for i := range members {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	memberInfo := []UserInfo{}
+	for _, ui := range results {
+		if ui != nil {
+			memberInfo = append(memberInfo, *ui)
+		}
+	}
+
+	return memberInfo
+}
+
+// getMemberInfo fetches the profile and keys of a team member. The requests
+// are cancelled if they do not complete within k.memberTimeout, and the last
+// known keys are used instead, so that a single slow user does not hold up the
+// whole team. It returns nil if the member has no keys.
+func (k *KeyCollector) getMemberInfo(tm *github.User, lastKnown map[int]UserInfo) *UserInfo {
+	ctx, cancel := context.Background(), func() {}
+	if k.memberTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, k.memberTimeout)
+	}
+	defer cancel()
+
+	name, nameOK := k.getUserName(ctx, *tm.ID, *tm.Login)
+	keys, err := k.getUserKeys(ctx, *tm.Login)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", k.memberTimeout)
+	}
+
+	ui := UserInfo{
+		Login: *tm.Login,
+		ID:    *tm.ID,
+		Name:  "unknown name",
+		Keys:  []SSHKey{},
+	}
+
+	previous, hasPrevious := lastKnown[*tm.ID]
+
+	if nameOK {
+		ui.Name = name
+	} else if hasPrevious {
+		ui.Name = previous.Name
+	}
+
+	if err != nil && hasPrevious && len(previous.Keys) > 0 {
+		simplelog.Infof("Could not fetch keys for user '%s', using last known keys: %v", *tm.Login, err)
+		ui.Keys = previous.Keys
+		ui.Stale = true
+	} else if err != nil {
+		simplelog.Infof("Could not fetch keys for user '%s': %v", *tm.Login, err)
+	} else {
+		ui.Keys = keys
+	}
+
+	if len(ui.Keys) == 0 {
+		simplelog.Infof("No public SSH keys for user '%s'", *tm.Login)
+		return nil
+	}
+
+	return &ui
+}
+
+// getChildTeams returns the teams that are direct children of the specified
+// team. The version of go-github in use does not support nested teams, so the
+// request is constructed manually.
+func (k *KeyCollector) getChildTeams(teamID int) ([]*github.Team, error) {
+	childTeams := []*github.Team{}
+	page := 0
+
+	simplelog.Debugf("Fetching a list of child teams for team with ID %d", teamID)
+
+	for {
+		req, err := k.githubClient.NewRequest("GET", fmt.Sprintf("teams/%d/teams?per_page=100&page=%d", teamID, page), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", githubNestedTeamsMediaType)
+
+		teams := []*github.Team{}
+		resp, err := k.githubClient.Do(req, &teams)
+		if err != nil {
+			return nil, err
+		}
+
+		childTeams = append(childTeams, teams...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		page = resp.NextPage
+	}
+
+	return childTeams, nil
+}
+
+// indexUserInfo returns a map of the provided UserInfo structs, keyed by the
+// GitHub user ID.
+func indexUserInfo(users []UserInfo) map[int]UserInfo {
+	index := map[int]UserInfo{}
+	for _, ui := range users {
+		index[ui.ID] = ui
+	}
+
+	return index
+}
+
+// teamIdentifier returns the slug of a team, falling back to its name.
+func teamIdentifier(team *github.Team) string {
+	if team.Slug != nil && *team.Slug != "" {
+		return *team.Slug
+	}
+
+	if team.Name != nil {
+		return *team.Name
+	}
+
+	return ""
+}
+
+// getUserName returns the display name of the user, from the profile cache if
+// it is fresh. It returns false if the profile could not be fetched and there
+// is no cached name for the user. The version of go-github in use does not
+// support contexts, so the request is constructed manually.
+func (k *KeyCollector) getUserName(ctx context.Context, userID int, userLogin string) (string, bool) {
+	cachedName, cached, fresh := k.profiles.Get(userID)
+	if fresh {
+		return cachedName, true
+	}
+
+	req, err := k.githubClient.NewRequest("GET", fmt.Sprintf("user/%d", userID), nil)
+	if err != nil {
+		simplelog.Infof("Could not fetch details for user '%s': %v", userLogin, err)
+		return cachedName, cached
+	}
+
+	user := &github.User{}
+	if _, err := k.githubClient.Do(req.WithContext(ctx), user); err != nil {
+		simplelog.Infof("Could not fetch details for user '%s': %v", userLogin, err)
+		return cachedName, cached
+	}
+
+	name := "unknown name"
+	if user.Name != nil {
+		name = *user.Name
+	}
+
+	k.profiles.Set(userID, name)
+
+	return name, true
+}
+
+func (k *KeyCollector) getUserKeys(ctx context.Context, userLogin string) ([]SSHKey, error) {
 	// Instead of using github.Users.ListKeys() which calls the GitHub API and is
 	// a throttled request, we simply fetch them from the public URL that is
 	// provided by GitHub.
 	simplelog.Debugf("Fetching keys for user '%s'", userLogin)
 
-	response, err := k.httpClient.Get(fmt.Sprintf(k.githubKeysURL, userLogin))
+	req, err := http.NewRequest("GET", fmt.Sprintf(k.githubKeysURL, userLogin), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := k.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// the account has been deleted or renamed, so its keys must not be kept
+	if response.StatusCode == http.StatusNotFound {
+		simplelog.Infof("User '%s' was not found on github, removing their keys", userLogin)
+		return []SSHKey{}, nil
 	}
 
 	if response.StatusCode != http.StatusOK {
-		simplelog.Errorf("Could not fetch keys for user '%s': github returned status code %v", response.StatusCode)
-		return "", ErrCouldNotFetchGithubKeys
+		simplelog.Errorf("Could not fetch keys for user '%s': github returned status code %v", userLogin, response.StatusCode)
+		return nil, ErrCouldNotFetchGithubKeys
+	}
+
+	keys, errs := ParseSSHKeys(string(body))
+	for _, err := range errs {
+		simplelog.Infof("Rejected invalid SSH key for user '%s': %v", userLogin, err)
 	}
 
-	return strings.TrimSpace(string(body)), nil
+	return keys, nil
 }
@@ -1,15 +1,22 @@
 package gskp
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"golang.org/x/oauth2"
 )
 
 var (
@@ -27,6 +34,35 @@ var (
 
 	// testHTTPClient is the HTTP client being tested (used in testKeyCollector)
 	testHTTPClient *http.Client
+
+	// testPublicKey is the public key returned for the mock user, in the same
+	// format that GitHub uses (no comment)
+	testPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/"
+
+	// testSSHKey is testPublicKey parsed
+	testSSHKey = SSHKey{
+		Type:        "ssh-ed25519",
+		Bits:        256,
+		Fingerprint: "SHA256:f7tjoDWr4mjTalf8ewxa3DmBV48XxT+WjHTRElWWigY",
+		Key:         testPublicKey,
+	}
+
+	// testSSHKeyRSA is a 2048 bit RSA key
+	testSSHKeyRSA = SSHKey{
+		Type:        "ssh-rsa",
+		Bits:        2048,
+		Fingerprint: "SHA256:Pjo9Ui8zXDrroUBIo6wIREoM+d1VlQAzryIutWnCqEU",
+		Comment:     "user@desktop",
+		Key:         "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC/oF7V47yexBD7Gih49PuZS1hg08p1WNjkZIvGOK4/C1kSanB3Zm96VBwhNxgDEOH5chzRLaORcziVu96W+9Ias9A8XP4pw4Z2bkz1tIkbrnSRRwzcQP0Bsf/xWfsQrZpEMFyTabK1scwRxjBt29UBIL5Kpoxei4iyDjRVVEOptecwfGrKVIlBkym5rkT2fTaQu3JQnFMVcdzoobrD/XbqBxN8Uc0mobwnDYUdMKr0jIMgvzKU0RHgpvE6qOQD7kv9NuENIHvYCGKniFNaHgpz3xSeFMrUWoSJSgM66ALsXqDj90MCrMOM6o/ZYz4Mao1DR2XLeoHUX2EW2YBSkVVl",
+	}
+
+	// testSSHKeySRE is the key of the mock user in a child team
+	testSSHKeySRE = SSHKey{
+		Type:        "ssh-ed25519",
+		Bits:        256,
+		Fingerprint: "SHA256:fAxJTf+vo0mMP/KPYVA8bHC9LTc9Xxpa79y6i/dBLaA",
+		Key:         "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPLFs4I0pzZk/KhcwSyPFGRMpI17C4d7u1zV2y7j5o/A",
+	}
 )
 
 func init() {
@@ -65,7 +101,7 @@ func mockInstallHandlers(handlers []string) {
 			})
 		case "userKeys":
 			testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
-				fmt.Fprint(w, `ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string`)
+				fmt.Fprint(w, testPublicKey)
 			})
 		case "userInfo":
 			testMux.HandleFunc("/user/999999", func(w http.ResponseWriter, r *http.Request) {
@@ -94,7 +130,7 @@ func TestKeyCollector_GetTeamMemberInfo(t *testing.T) {
 			Login: "user",
 			ID:    999999,
 			Name:  "User Name",
-			Keys:  "ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string",
+			Keys:  []SSHKey{testSSHKey},
 		},
 	}
 
@@ -106,7 +142,7 @@ func TestKeyCollector_GetTeamMemberInfo(t *testing.T) {
 		t.Errorf("KeyCollector.GetTeamID returned an unexpected ID: %d", ti)
 	}
 
-	mi, err := testKeyCollector.GetTeamMemberInfo(ti)
+	mi, err := testKeyCollector.GetTeamMemberInfo(ti, nil)
 	if err != nil {
 		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
 	}
@@ -153,7 +189,7 @@ func TestKeyCollector_GetTeamMemberInfo_getTeamMembersError(t *testing.T) {
 	mockInstallHandlers([]string{"orgTeams"})
 	defer mockTeardown()
 
-	mi, err := testKeyCollector.GetTeamMemberInfo(888888)
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, nil)
 	if err == nil {
 		t.Errorf("KeyCollector.GetTeamMemberInfo should have returned an error")
 	}
@@ -164,12 +200,12 @@ func TestKeyCollector_GetTeamMemberInfo_getTeamMembersError(t *testing.T) {
 }
 
 func TestKeyCollector_getUserKeys_error(t *testing.T) {
-	mi, err := testKeyCollector.getUserKeys("")
+	mi, err := testKeyCollector.getUserKeys(context.Background(), "")
 	if err == nil {
 		t.Errorf("KeyCollector.getUserKeys should have returned an error")
 	}
 
-	if mi != "" {
+	if mi != nil {
 		t.Errorf("KeyCollector.getUserKeys returned unexpected value: %v", mi)
 	}
 }
@@ -182,16 +218,536 @@ func TestKeyCollector_getUserKeys_notFound(t *testing.T) {
 		w.WriteHeader(http.StatusNotFound)
 	})
 
-	mi, err := testKeyCollector.getUserKeys("user")
-	if err == nil {
-		t.Errorf("KeyCollector.getUserKeys should have returned an error")
+	mi, err := testKeyCollector.getUserKeys(context.Background(), "user")
+	if err != nil {
+		t.Errorf("KeyCollector.getUserKeys returned an error for a missing user: %v", err)
 	}
 
-	if err != ErrCouldNotFetchGithubKeys {
-		t.Errorf("KeyCollector.getUserKeys returned an unexpected error: %v", err)
+	if len(mi) != 0 {
+		t.Errorf("KeyCollector.getUserKeys returned unexpected value: %v", mi)
 	}
+}
 
-	if mi != "" {
-		t.Errorf("KeyCollector.getUserKeys returned unexpected value: %v", mi)
+func TestKeyCollector_GetTeamMemberInfo_deletedUserRemoved(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"userInfo", "teamUserList"})
+	defer mockTeardown()
+
+	testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	lastKnown := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKeyRSA}},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, lastKnown)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	if len(mi) != 0 {
+		t.Errorf("KeyCollector.GetTeamMemberInfo kept the last known keys of a deleted user: %v", mi)
+	}
+}
+
+func TestMergeUserInfo(t *testing.T) {
+	platform := []UserInfo{
+		UserInfo{Login: "user00", ID: 999998, Name: "User Zero", Keys: []SSHKey{testSSHKey}},
+		UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKeyRSA}},
+	}
+	oncall := []UserInfo{
+		UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKeyRSA}},
+		UserInfo{Login: "user02", ID: 999997, Name: "User Two", Keys: []SSHKey{testSSHKeySRE}},
+	}
+
+	miExpected := []UserInfo{platform[0], platform[1], oncall[1]}
+
+	mi := MergeUserInfo(platform, oncall)
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("MergeUserInfo returned unexpected value: %v", mi)
+	}
+
+	if mi := MergeUserInfo(); len(mi) != 0 {
+		t.Errorf("MergeUserInfo returned unexpected value for no input: %v", mi)
+	}
+
+	// the same ID in another source is a different user
+	bots := []UserInfo{UserInfo{Login: "deploy-bot", ID: 999999, Source: fileKeySourceName, Name: "CI deploy bot", Keys: []SSHKey{testSSHKey}}}
+	if mi := MergeUserInfo(platform, bots); !reflect.DeepEqual(mi, []UserInfo{platform[0], platform[1], bots[0]}) {
+		t.Errorf("MergeUserInfo merged users of different sources: %v", mi)
+	}
+}
+
+func TestKeyCollector_GetNestedTeamMemberInfo(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"userKeys", "userInfo"})
+	defer mockTeardown()
+
+	testMux.HandleFunc("/teams/888888", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "Engineering", "slug": "engineering", "id": 888888}`)
+	})
+	testMux.HandleFunc("/teams/888888/members", func(w http.ResponseWriter, r *http.Request) {
+		// like GitHub, the members of child teams are included
+		fmt.Fprint(w, `[{"login": "user", "id": 999999}, {"login": "sre", "id": 999998}]`)
+	})
+	testMux.HandleFunc("/teams/888888/teams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != githubNestedTeamsMediaType {
+			t.Errorf("Unexpected Accept header when listing child teams: %s", r.Header.Get("Accept"))
+		}
+		fmt.Fprint(w, `[{"name": "Platform", "slug": "platform", "id": 777777}]`)
+	})
+	testMux.HandleFunc("/teams/777777/members", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"login": "sre", "id": 999998}]`)
+	})
+	testMux.HandleFunc("/teams/777777/teams", func(w http.ResponseWriter, r *http.Request) {
+		// a loop back to the parent should not be followed
+		fmt.Fprint(w, `[{"name": "Engineering", "slug": "engineering", "id": 888888}]`)
+	})
+	testMux.HandleFunc("/sre.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testSSHKeySRE.Key)
+	})
+	testMux.HandleFunc("/user/999998", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 999998, "name": "SRE User"}`)
+	})
+
+	miExpected := []UserInfo{
+		UserInfo{
+			Login:     "user",
+			ID:        999999,
+			Name:      "User Name",
+			Keys:      []SSHKey{testSSHKey},
+			GrantedBy: "engineering",
+		},
+		UserInfo{
+			Login:     "sre",
+			ID:        999998,
+			Name:      "SRE User",
+			Keys:      []SSHKey{testSSHKeySRE},
+			GrantedBy: "platform",
+		},
+	}
+
+	mi, err := testKeyCollector.GetNestedTeamMemberInfo(888888, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetNestedTeamMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetNestedTeamMemberInfo returned unexpected value: %v", mi)
+	}
+}
+
+func TestKeyCollector_GetTeamID_paginationAndSlug(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	testMux.HandleFunc("/orgs/none/teams", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `[{"name": "Owners Team", "slug": "owners", "id": 888888}]`)
+			return
+		}
+
+		w.Header().Set("Link", fmt.Sprintf(`<%s/orgs/none/teams?page=2>; rel="next"`, testServer.URL))
+		fmt.Fprint(w, `[{"name": "owners", "slug": "renamed-owners", "id": 777777}, {"name": "Platform", "slug": "platform", "id": 666666}]`)
+	})
+
+	var tests = []struct {
+		Team     string
+		Expected int
+	}{
+		{"owners", 888888},
+		{"Owners Team", 888888},
+		{"renamed-owners", 777777},
+		{"Platform", 666666},
+		{"platform", 666666},
+	}
+
+	for _, test := range tests {
+		ti, err := testKeyCollector.GetTeamID("none", test.Team)
+		if err != nil {
+			t.Fatalf("KeyCollector.GetTeamID returned an error for team '%s': %v", test.Team, err)
+		}
+
+		if ti != test.Expected {
+			t.Errorf("KeyCollector.GetTeamID returned an unexpected ID for team '%s': %d", test.Team, ti)
+		}
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfo_lastKnownKeys(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"userInfo", "teamUserList"})
+	defer mockTeardown()
+
+	testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	lastKnown := []UserInfo{
+		UserInfo{
+			Login: "user",
+			ID:    999999,
+			Name:  "User Name",
+			Keys:  []SSHKey{testSSHKeyRSA},
+		},
+	}
+
+	miExpected := []UserInfo{
+		UserInfo{
+			Login: "user",
+			ID:    999999,
+			Name:  "User Name",
+			Keys:  []SSHKey{testSSHKeyRSA},
+			Stale: true,
+		},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, lastKnown)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetTeamMemberInfo returned unexpected value: %v", mi)
+	}
+
+	mi, err = testKeyCollector.GetTeamMemberInfo(888888, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	if len(mi) != 0 {
+		t.Errorf("KeyCollector.GetTeamMemberInfo returned unexpected value without last known keys: %v", mi)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfo_noKeysRemovesUser(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"userInfo", "teamUserList"})
+	defer mockTeardown()
+
+	testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "")
+	})
+
+	lastKnown := []UserInfo{
+		UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKeyRSA}},
+	}
+
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, lastKnown)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	if len(mi) != 0 {
+		t.Errorf("KeyCollector.GetTeamMemberInfo should have removed a user without keys: %v", mi)
+	}
+}
+
+func TestKeyCollector_getUserKeys_invalidLines(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s\nssh-rsa not_a_valid_key\n\n%s\n", testPublicKey, testSSHKeyRSA)
+	})
+
+	keys, err := testKeyCollector.getUserKeys(context.Background(), "user")
+	if err != nil {
+		t.Fatalf("KeyCollector.getUserKeys returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(keys, []SSHKey{testSSHKey, testSSHKeyRSA}) {
+		t.Errorf("KeyCollector.getUserKeys returned unexpected value: %v", keys)
+	}
+}
+
+func TestUserInfo_JSON(t *testing.T) {
+	ui := UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey, testSSHKeyRSA}}
+
+	jsonText, err := json.Marshal(ui)
+	if err != nil {
+		t.Fatalf("json.Marshal returned an error: %v", err)
+	}
+
+	var legacy struct {
+		Keys string `json:"keys"`
+	}
+	if err := json.Unmarshal(jsonText, &legacy); err != nil {
+		t.Fatalf("json.Unmarshal returned an error for the legacy format: %v", err)
+	}
+
+	if legacy.Keys != testPublicKey+"\n"+testSSHKeyRSA.String() {
+		t.Errorf("UserInfo JSON has unexpected legacy keys: %s", legacy.Keys)
+	}
+
+	var decoded UserInfo
+	if err := json.Unmarshal(jsonText, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, ui) {
+		t.Errorf("UserInfo did not survive a JSON round trip: %v", decoded)
+	}
+
+	// responses from older collectors only contain the legacy keys string
+	if err := json.Unmarshal([]byte(`{"login":"user","id":999999,"name":"User Name","keys":"`+testPublicKey+`"}`), &decoded); err != nil {
+		t.Fatalf("json.Unmarshal returned an error for the legacy format: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Keys, []SSHKey{testSSHKey}) {
+		t.Errorf("UserInfo has unexpected keys when decoded from the legacy format: %v", decoded.Keys)
+	}
+}
+
+func TestNewEnterpriseKeyCollector(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/orgs/none/teams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ghe_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[{"name": "Owners", "id": 888888}]`)
+	})
+	mux.HandleFunc("/api/v3/teams/888888/members", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"login": "user", "id": 999999}]`)
+	})
+	mux.HandleFunc("/api/v3/user/999999", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 999999, "name": "User Name"}`)
+	})
+	mux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testPublicKey)
+	})
+
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	caBundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ghe_token"})
+
+	if _, err := NewEnterpriseKeyCollector(tokenSource, GithubEndpoints{BaseURL: server.URL + "/api/v3"}); err != nil {
+		t.Fatalf("NewEnterpriseKeyCollector returned an error: %v", err)
+	}
+
+	k, err := NewEnterpriseKeyCollector(tokenSource, GithubEndpoints{
+		BaseURL:   server.URL + "/api/v3",
+		UploadURL: server.URL + "/api/uploads",
+		CABundle:  caBundle,
+	})
+	if err != nil {
+		t.Fatalf("NewEnterpriseKeyCollector returned an error: %v", err)
+	}
+
+	if k.githubKeysURL != server.URL+"/%s.keys" {
+		t.Errorf("NewEnterpriseKeyCollector derived unexpected keys URL: %s", k.githubKeysURL)
+	}
+
+	ti, err := k.GetTeamID("none", "Owners")
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamID returned an error: %v", err)
+	}
+
+	mi, err := k.GetTeamMemberInfo(ti, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	miExpected := []UserInfo{UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}}}
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("KeyCollector.GetTeamMemberInfo returned unexpected value: %v", mi)
+	}
+
+	// without the CA bundle the server certificate is not trusted
+	k, err = NewEnterpriseKeyCollector(tokenSource, GithubEndpoints{BaseURL: server.URL + "/api/v3/"})
+	if err != nil {
+		t.Fatalf("NewEnterpriseKeyCollector returned an error: %v", err)
+	}
+
+	if _, err := k.GetTeamID("none", "Owners"); err == nil {
+		t.Error("KeyCollector.GetTeamID should have returned an error for an untrusted certificate")
+	}
+}
+
+func TestNewEnterpriseKeyCollector_invalidConfig(t *testing.T) {
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ghe_token"})
+
+	for _, endpoints := range []GithubEndpoints{
+		GithubEndpoints{BaseURL: "github.example.com/api/v3/"},
+		GithubEndpoints{UploadURL: "://github.example.com/"},
+		GithubEndpoints{KeysURL: "https://github.example.com/keys"},
+		GithubEndpoints{KeysURL: "https://github.example.com/%s/%d.keys"},
+		GithubEndpoints{CABundle: []byte("not a certificate")},
+	} {
+		if _, err := NewEnterpriseKeyCollector(tokenSource, endpoints); err == nil {
+			t.Errorf("NewEnterpriseKeyCollector should have returned an error for %+v", endpoints)
+		}
+	}
+
+	k, err := NewEnterpriseKeyCollector(tokenSource, GithubEndpoints{KeysURL: "https://keys.example.com/%s"})
+	if err != nil {
+		t.Fatalf("NewEnterpriseKeyCollector returned an error: %v", err)
+	}
+
+	if k.githubKeysURL != "https://keys.example.com/%s" || k.githubClient.BaseURL.String() != "https://api.github.com/" {
+		t.Errorf("NewEnterpriseKeyCollector returned unexpected endpoints: %s, %s", k.githubKeysURL, k.githubClient.BaseURL)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfo_profileCache(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"teamUserList"})
+	defer mockTeardown()
+
+	profileRequests := 0
+	testMux.HandleFunc("/user/999999", func(w http.ResponseWriter, r *http.Request) {
+		profileRequests++
+		if profileRequests > 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"id": 999999, "name": "User Name"}`)
+	})
+
+	keys := testPublicKey
+	testMux.HandleFunc("/user.keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, keys)
+	})
+
+	testKeyCollector.profiles = newProfileCache(time.Hour)
+	defer func() { testKeyCollector.profiles = nil }()
+
+	for _, expected := range []SSHKey{testSSHKey, testSSHKeyRSA} {
+		keys = expected.String()
+
+		mi, err := testKeyCollector.GetTeamMemberInfo(888888, nil)
+		if err != nil {
+			t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+		}
+
+		miExpected := []UserInfo{UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{expected}}}
+		if !reflect.DeepEqual(mi, miExpected) {
+			t.Errorf("KeyCollector.GetTeamMemberInfo returned unexpected value: %v", mi)
+		}
+	}
+
+	if profileRequests != 1 {
+		t.Errorf("expected the profile to be fetched once, got %d requests", profileRequests)
+	}
+
+	// an expired profile is fetched again, but the cached name is used if
+	// that fails
+	testKeyCollector.profiles.SetTTL(0)
+
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, nil)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	if profileRequests != 2 || len(mi) != 1 || mi[0].Name != "User Name" {
+		t.Errorf("unexpected result with an expired profile: %d requests, %v", profileRequests, mi)
+	}
+}
+
+func TestKeyCollector_GetTeamMemberInfo_concurrent(t *testing.T) {
+	mockSetup()
+	defer mockTeardown()
+
+	const members = 20
+
+	memberList := []string{}
+	for i := 1; i <= members; i++ {
+		memberList = append(memberList, fmt.Sprintf(`{"login": "user%d", "id": %d}`, i, i))
+	}
+
+	const workers = 5
+
+	inFlight, maxInFlight := 0, 0
+	mutex := &sync.Mutex{}
+
+	// every worker has a request in flight before any of them is answered
+	allBusy := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	testMux.HandleFunc("/teams/888888/members", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "[%s]", strings.Join(memberList, ","))
+	})
+	testMux.HandleFunc("/user/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": 1, "name": "Name of %s"}`, strings.TrimPrefix(r.URL.Path, "/user/"))
+	})
+	testMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		if maxInFlight == workers {
+			select {
+			case <-allBusy:
+			default:
+				close(allBusy)
+			}
+		}
+		mutex.Unlock()
+
+		defer func() {
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+		}()
+
+		// user1 never responds, so its request must be cancelled
+		var id int
+		fmt.Sscanf(r.URL.Path, "/user%d.keys", &id)
+		if id == 1 {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		<-allBusy
+		fmt.Fprint(w, testPublicKey)
+	})
+
+	concurrency, memberTimeout := testKeyCollector.concurrency, testKeyCollector.memberTimeout
+	testKeyCollector.SetMemberFetchConcurrency(workers, 500*time.Millisecond)
+	defer testKeyCollector.SetMemberFetchConcurrency(concurrency, memberTimeout)
+
+	lastKnown := []UserInfo{UserInfo{Login: "user1", ID: 1, Name: "Name of 1", Keys: []SSHKey{testSSHKeyRSA}}}
+
+	mi, err := testKeyCollector.GetTeamMemberInfo(888888, lastKnown)
+	if err != nil {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned an error: %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the request for the slow user was not cancelled")
+	}
+
+	if len(mi) != members {
+		t.Fatalf("KeyCollector.GetTeamMemberInfo returned %d members, expected %d", len(mi), members)
+	}
+
+	for i, ui := range mi {
+		if ui.ID != i+1 || ui.Name != fmt.Sprintf("Name of %d", i+1) {
+			t.Errorf("KeyCollector.GetTeamMemberInfo returned member %d out of order: %v", i, ui)
+		}
+	}
+
+	if !mi[0].Stale || !reflect.DeepEqual(mi[0].Keys, []SSHKey{testSSHKeyRSA}) {
+		t.Errorf("the slow user should have their last known keys: %v", mi[0])
+	}
+
+	// the server can notice the cancelled request after its worker has moved
+	// on to the next member
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxInFlight > workers+1 {
+		t.Errorf("unexpected number of parallel requests: %d", maxInFlight)
 	}
 }
@@ -0,0 +1,84 @@
+package gskp
+
+// KeyDiff is the difference between two versions of the keys of a team.
+// Users are matched by their source and ID, and keys by their fingerprint.
+// Users without any keys are left out of AddedUsers and RemovedUsers, since
+// they never had access. The keys of added and removed users are included in
+// AddedKeys and RemovedKeys, so that those list every key that gained or lost
+// access.
+type KeyDiff struct {
+	From         uint64     `json:"from"`
+	To           uint64     `json:"to"`
+	AddedUsers   []DiffUser `json:"added_users"`
+	RemovedUsers []DiffUser `json:"removed_users"`
+	AddedKeys    []UserKey  `json:"added_keys"`
+	RemovedKeys  []UserKey  `json:"removed_keys"`
+}
+
+// DiffUser identifies a user in a KeyDiff. Source is empty for GitHub users,
+// as in UserInfo.
+type DiffUser struct {
+	Login  string `json:"login"`
+	Source string `json:"source,omitempty"`
+}
+
+// UserKey identifies a single key of a user in a KeyDiff.
+type UserKey struct {
+	Login       string `json:"login"`
+	Source      string `json:"source,omitempty"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Empty returns whether no users or keys were added or removed.
+func (d KeyDiff) Empty() bool {
+	return len(d.AddedKeys) == 0 && len(d.RemovedKeys) == 0 &&
+		len(d.AddedUsers) == 0 && len(d.RemovedUsers) == 0
+}
+
+// DiffUserInfo returns the users and keys that are in to but not in from as
+// added, and those that are in from but not in to as removed. Users and keys
+// are listed in the order they appear in.
+func DiffUserInfo(from []UserInfo, to []UserInfo) KeyDiff {
+	diff := KeyDiff{
+		AddedUsers:   []DiffUser{},
+		RemovedUsers: []DiffUser{},
+		AddedKeys:    []UserKey{},
+		RemovedKeys:  []UserKey{},
+	}
+
+	diff.AddedUsers, diff.AddedKeys = diffUsers(from, to, diff.AddedUsers, diff.AddedKeys)
+	diff.RemovedUsers, diff.RemovedKeys = diffUsers(to, from, diff.RemovedUsers, diff.RemovedKeys)
+
+	return diff
+}
+
+// diffUsers appends the users of b with keys that are not in a, and the keys
+// of b that the same user does not have in a.
+func diffUsers(a []UserInfo, b []UserInfo, users []DiffUser, keys []UserKey) ([]DiffUser, []UserKey) {
+	fingerprints := map[userIdentity]map[string]bool{}
+	for _, ui := range a {
+		if fingerprints[ui.identity()] == nil {
+			fingerprints[ui.identity()] = map[string]bool{}
+		}
+
+		for _, key := range ui.Keys {
+			fingerprints[ui.identity()][key.Fingerprint] = true
+		}
+	}
+
+	for _, ui := range b {
+		existing := fingerprints[ui.identity()]
+		if len(existing) == 0 && len(ui.Keys) > 0 {
+			users = append(users, DiffUser{Login: ui.Login, Source: ui.Source})
+		}
+
+		for _, key := range ui.Keys {
+			if !existing[key.Fingerprint] {
+				keys = append(keys, UserKey{Login: ui.Login, Source: ui.Source, Type: key.Type, Fingerprint: key.Fingerprint})
+			}
+		}
+	}
+
+	return users, keys
+}
@@ -0,0 +1,64 @@
+package gskp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffUserInfo(t *testing.T) {
+	from := []UserInfo{
+		UserInfo{Login: "alice", ID: 1, Keys: []SSHKey{testSSHKey}},
+		UserInfo{Login: "bob", ID: 2, Keys: []SSHKey{testSSHKey}},
+	}
+	to := []UserInfo{
+		UserInfo{Login: "alice", ID: 1, Keys: []SSHKey{testSSHKeyRSA}},
+		UserInfo{Login: "carol", ID: 3, Keys: []SSHKey{testSSHKey}},
+	}
+
+	expected := KeyDiff{
+		AddedUsers:   []DiffUser{DiffUser{Login: "carol"}},
+		RemovedUsers: []DiffUser{DiffUser{Login: "bob"}},
+		AddedKeys: []UserKey{
+			UserKey{Login: "alice", Type: testSSHKeyRSA.Type, Fingerprint: testSSHKeyRSA.Fingerprint},
+			UserKey{Login: "carol", Type: testSSHKey.Type, Fingerprint: testSSHKey.Fingerprint},
+		},
+		RemovedKeys: []UserKey{
+			UserKey{Login: "alice", Type: testSSHKey.Type, Fingerprint: testSSHKey.Fingerprint},
+			UserKey{Login: "bob", Type: testSSHKey.Type, Fingerprint: testSSHKey.Fingerprint},
+		},
+	}
+
+	if diff := DiffUserInfo(from, to); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("DiffUserInfo returned unexpected diff: %+v", diff)
+	}
+
+	if diff := DiffUserInfo(to, to); !diff.Empty() {
+		t.Errorf("DiffUserInfo returned changes for the same users: %+v", diff)
+	}
+
+	// a user of another source with the same ID is a different user
+	ldap := []UserInfo{UserInfo{Login: "alice-ldap", ID: 1, Source: ldapKeySourceName, Keys: []SSHKey{testSSHKeyRSA}}}
+	expected = KeyDiff{
+		AddedUsers:   []DiffUser{DiffUser{Login: "alice-ldap", Source: ldapKeySourceName}},
+		RemovedUsers: []DiffUser{DiffUser{Login: "alice"}},
+		AddedKeys: []UserKey{
+			UserKey{Login: "alice-ldap", Source: ldapKeySourceName, Type: testSSHKeyRSA.Type, Fingerprint: testSSHKeyRSA.Fingerprint},
+		},
+		RemovedKeys: []UserKey{
+			UserKey{Login: "alice", Type: testSSHKeyRSA.Type, Fingerprint: testSSHKeyRSA.Fingerprint},
+		},
+	}
+
+	if diff := DiffUserInfo(to[:1], ldap); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("DiffUserInfo returned unexpected diff for users of different sources: %+v", diff)
+	}
+
+	// users without keys never had access, so they are not listed
+	nokeys := []UserInfo{UserInfo{Login: "dave", ID: 4, Keys: []SSHKey{}}}
+	if diff := DiffUserInfo(nokeys, nil); !diff.Empty() {
+		t.Errorf("DiffUserInfo listed a removed user without keys: %+v", diff)
+	}
+	if diff := DiffUserInfo(nil, nokeys); !diff.Empty() {
+		t.Errorf("DiffUserInfo listed an added user without keys: %+v", diff)
+	}
+}
@@ -0,0 +1,136 @@
+package gskp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+var (
+	// keyTypeFamilies maps the SSH key types to the names that can be used in
+	// a KeyPolicy.
+	keyTypeFamilies = map[string]string{
+		"ssh-ed25519":                        "ed25519",
+		"ecdsa-sha2-nistp256":                "ecdsa",
+		"ecdsa-sha2-nistp384":                "ecdsa",
+		"ecdsa-sha2-nistp521":                "ecdsa",
+		"ssh-rsa":                            "rsa",
+		"ssh-dss":                            "dsa",
+		"sk-ssh-ed25519@openssh.com":         "sk",
+		"sk-ecdsa-sha2-nistp256@openssh.com": "sk",
+	}
+)
+
+// KeyPolicy decides which SSH keys are accepted by the collector.
+//
+// AllowedKeyTypes can contain the names "ed25519", "ecdsa", "rsa", "dsa" and
+// "sk" (for hardware backed keys), or the exact SSH key type (eg.
+// "ecdsa-sha2-nistp384"). If it is empty, all key types are allowed.
+// MinRSABits sets the minimum size for RSA keys, 0 means no minimum.
+type KeyPolicy struct {
+	AllowedKeyTypes []string `mapstructure:"allowedKeyTypes"`
+	MinRSABits      int      `mapstructure:"minRSABits"`
+}
+
+// RejectedSSHKey is an SSHKey that was not accepted by a KeyPolicy, along with
+// the reason it was rejected.
+type RejectedSSHKey struct {
+	SSHKey
+	Reason string `json:"reason"`
+}
+
+// Validate returns an error if the policy contains unknown key types.
+func (p *KeyPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	for _, t := range p.AllowedKeyTypes {
+		if !isKnownKeyType(t) {
+			return fmt.Errorf("unknown key type '%s' in key policy", t)
+		}
+	}
+
+	if p.MinRSABits < 0 {
+		return fmt.Errorf("invalid minimum RSA key size %d in key policy", p.MinRSABits)
+	}
+
+	return nil
+}
+
+// Check returns an error describing why the key is not allowed by the policy,
+// or nil if the key is allowed. A nil policy allows all keys.
+func (p *KeyPolicy) Check(key SSHKey) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.AllowedKeyTypes) > 0 && !p.allowsType(key.Type) {
+		return fmt.Errorf("key type %s is not allowed", key.Type)
+	}
+
+	if key.Type == "ssh-rsa" && key.Bits < p.MinRSABits {
+		return fmt.Errorf("RSA key has %d bits, at least %d are required", key.Bits, p.MinRSABits)
+	}
+
+	return nil
+}
+
+// Apply filters the keys of each user according to the policy. Rejected keys
+// are logged and moved to the RejectedKeys field of the user. Users whose keys
+// were all rejected are dropped, so that they are not served without keys.
+func (p *KeyPolicy) Apply(teamName string, users []UserInfo) []UserInfo {
+	if p == nil {
+		return users
+	}
+
+	ret := []UserInfo{}
+
+	for _, ui := range users {
+		accepted := []SSHKey{}
+
+		for _, key := range ui.Keys {
+			if err := p.Check(key); err != nil {
+				simplelog.Infof("Rejected SSH key %s of user '%s' for team '%s': %v", key.Fingerprint, ui.Login, teamName, err)
+				ui.RejectedKeys = append(ui.RejectedKeys, RejectedSSHKey{SSHKey: key, Reason: err.Error()})
+				continue
+			}
+
+			accepted = append(accepted, key)
+		}
+
+		if len(accepted) == 0 && len(ui.Keys) > 0 {
+			simplelog.Infof("No SSH keys allowed by the key policy for user '%s' in team '%s', dropping the user", ui.Login, teamName)
+			continue
+		}
+
+		ui.Keys = accepted
+		ret = append(ret, ui)
+	}
+
+	return ret
+}
+
+func (p *KeyPolicy) allowsType(keyType string) bool {
+	for _, t := range p.AllowedKeyTypes {
+		t = strings.ToLower(t)
+		if t == keyType || t == keyTypeFamilies[keyType] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isKnownKeyType(name string) bool {
+	name = strings.ToLower(name)
+
+	for keyType, family := range keyTypeFamilies {
+		if name == keyType || name == family {
+			return true
+		}
+	}
+
+	return false
+}
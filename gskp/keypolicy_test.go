@@ -0,0 +1,84 @@
+package gskp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+var testSSHKeyWeakRSA = SSHKey{
+	Type:        "ssh-rsa",
+	Bits:        1024,
+	Fingerprint: "SHA256:mRKBoNe9DU7hqmH5VK0Rqhh9xNaFKpDLQ/Ifrm9JWb0",
+	Key:         "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC6yrcjtmNvRWkM2Y1m68GVjQf3HcYMaEgdZs+wL5wgqvbjBUoUHU4EmPxlTczg92V4Y1GEL/+4DUtd14PXIh8hX+zEqDMsXWRDa7FocKp478uxIP6z6EHvUmxrK959Po63MXlzqNKmXWBKeIrfEbv8KMXJ1N3yXDHxHmOZL4Za1Q==",
+}
+
+var keyPolicyCheckTests = []struct {
+	Policy  *KeyPolicy
+	Key     SSHKey
+	Allowed bool
+}{
+	{nil, testSSHKeyWeakRSA, true},
+	{&KeyPolicy{}, testSSHKeyWeakRSA, true},
+	{&KeyPolicy{MinRSABits: 2048}, testSSHKeyWeakRSA, false},
+	{&KeyPolicy{MinRSABits: 2048}, testSSHKeyRSA, true},
+	{&KeyPolicy{MinRSABits: 2048}, testSSHKey, true},
+	{&KeyPolicy{AllowedKeyTypes: []string{"ed25519"}}, testSSHKey, true},
+	{&KeyPolicy{AllowedKeyTypes: []string{"ed25519"}}, testSSHKeyRSA, false},
+	{&KeyPolicy{AllowedKeyTypes: []string{"ssh-rsa"}}, testSSHKeyRSA, true},
+	{&KeyPolicy{AllowedKeyTypes: []string{"sk"}}, SSHKey{Type: "sk-ssh-ed25519@openssh.com", Bits: 256}, true},
+	{&KeyPolicy{AllowedKeyTypes: []string{"ECDSA"}}, SSHKey{Type: "ecdsa-sha2-nistp384", Bits: 384}, true},
+	{&KeyPolicy{AllowedKeyTypes: []string{"ecdsa", "rsa"}}, SSHKey{Type: "ssh-dss", Bits: 1024}, false},
+}
+
+func TestKeyPolicy_Check(t *testing.T) {
+	for i, test := range keyPolicyCheckTests {
+		err := test.Policy.Check(test.Key)
+		if test.Allowed && err != nil {
+			t.Errorf("KeyPolicy.Check returned an unexpected error for test #%d: %v", i, err)
+		} else if !test.Allowed && err == nil {
+			t.Errorf("KeyPolicy.Check should have rejected the key for test #%d", i)
+		}
+	}
+}
+
+func TestKeyPolicy_Validate(t *testing.T) {
+	if err := (&KeyPolicy{AllowedKeyTypes: []string{"ed25519", "ecdsa-sha2-nistp521", "sk"}, MinRSABits: 2048}).Validate(); err != nil {
+		t.Errorf("KeyPolicy.Validate returned an unexpected error: %v", err)
+	}
+
+	if err := (&KeyPolicy{AllowedKeyTypes: []string{"ed448"}}).Validate(); err == nil {
+		t.Errorf("KeyPolicy.Validate should have returned an error for an unknown key type")
+	}
+}
+
+func TestKeyPolicy_Apply(t *testing.T) {
+	users := []UserInfo{
+		UserInfo{Login: "user00", ID: 999998, Name: "User Zero", Keys: []SSHKey{testSSHKey, testSSHKeyWeakRSA}},
+		UserInfo{Login: "user01", ID: 999999, Name: "User One", Keys: []SSHKey{testSSHKeyWeakRSA}},
+	}
+
+	expected := []UserInfo{
+		UserInfo{
+			Login: "user00",
+			ID:    999998,
+			Name:  "User Zero",
+			Keys:  []SSHKey{testSSHKey},
+			RejectedKeys: []RejectedSSHKey{
+				RejectedSSHKey{SSHKey: testSSHKeyWeakRSA, Reason: "RSA key has 1024 bits, at least 2048 are required"},
+			},
+		},
+	}
+
+	policy := &KeyPolicy{AllowedKeyTypes: []string{"ed25519", "rsa"}, MinRSABits: 2048}
+
+	filtered := policy.Apply("Owners", users)
+	if !reflect.DeepEqual(filtered, expected) {
+		t.Errorf("KeyPolicy.Apply returned unexpected value: %v", filtered)
+	}
+}
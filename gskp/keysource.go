@@ -0,0 +1,121 @@
+package gskp
+
+import (
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+// KeySource resolves a group of users, such as a GitHub team, to its members
+// and their public SSH keys.
+type KeySource interface {
+	// GetGroupMemberInfo returns the members of the group along with their
+	// SSH keys. lastKnown holds the previous result for the same group, which
+	// can be used to fill in for users whose keys cannot be fetched. If the
+	// group does not exist, ErrTeamNotFound is returned.
+	GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error)
+}
+
+// userSourceKeySource is implemented by the KeySources that set the Source of
+// the users they return. Users with an empty Source come from GitHub.
+type userSourceKeySource interface {
+	userSource() string
+}
+
+// keySourceName returns the Source of the users that come from the source.
+func keySourceName(source KeySource) string {
+	if s, ok := source.(userSourceKeySource); ok {
+		return s.userSource()
+	}
+
+	return ""
+}
+
+// MultiKeySource combines the results of several KeySources. The members of a
+// group are merged from all the sources that know about the group, with
+// users de-duplicated by their source and ID.
+type MultiKeySource struct {
+	sources []KeySource
+}
+
+// NewMultiKeySource returns a MultiKeySource for the provided sources. Users
+// found in earlier sources take precedence over those in later ones.
+func NewMultiKeySource(sources ...KeySource) *MultiKeySource {
+	return &MultiKeySource{
+		sources: sources,
+	}
+}
+
+// GetGroupMemberInfo returns the merged members of the group from all the
+// sources. Each source is only given its own users from lastKnown. If a source
+// fails with an error other than ErrTeamNotFound, its users from lastKnown are
+// used instead and marked as stale, so that a failing source neither revokes
+// access nor holds up the keys of the others. The error is only returned if
+// no source succeeded. If no source knows about the group, ErrTeamNotFound is
+// returned.
+func (m *MultiKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	sets := [][]UserInfo{}
+	succeeded := false
+	var lastErr error
+
+	for _, source := range m.sources {
+		name := keySourceName(source)
+		sourceLastKnown := usersFromSource(lastKnown, name)
+
+		data, err := source.GetGroupMemberInfo(groupName, sourceLastKnown)
+		if err == ErrTeamNotFound {
+			continue
+		} else if err != nil {
+			simplelog.Errorf("could not get members of group '%s' from a key source, using %d last known users: %v", groupName, len(sourceLastKnown), err)
+			lastErr = err
+
+			stale := []UserInfo{}
+			for _, ui := range sourceLastKnown {
+				ui.Stale = true
+				stale = append(stale, ui)
+			}
+			sets = append(sets, stale)
+
+			continue
+		}
+
+		succeeded = true
+		sets = append(sets, data)
+	}
+
+	if !succeeded && lastErr != nil {
+		return nil, lastErr
+	}
+
+	if len(sets) == 0 {
+		return nil, ErrTeamNotFound
+	}
+
+	return MergeUserInfo(sets...), nil
+}
+
+// usersFromSource returns the users that have the provided Source.
+func usersFromSource(users []UserInfo, source string) []UserInfo {
+	ret := []UserInfo{}
+	for _, ui := range users {
+		if ui.Source == source {
+			ret = append(ret, ui)
+		}
+	}
+
+	return ret
+}
+
+// flattenKeySources returns the source itself or, for a MultiKeySource, all
+// of the sources it combines.
+func flattenKeySources(source KeySource) []KeySource {
+	multi, ok := source.(*MultiKeySource)
+	if !ok {
+		return []KeySource{source}
+	}
+
+	sources := []KeySource{}
+	for _, s := range multi.sources {
+		sources = append(sources, flattenKeySources(s)...)
+	}
+
+	return sources
+}
@@ -0,0 +1,116 @@
+package gskp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+type testErrorKeySource struct{}
+
+func (testErrorKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	return nil, errors.New("source is down")
+}
+
+func TestMultiKeySource_GetGroupMemberInfo(t *testing.T) {
+	user := UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}}
+	bot := UserInfo{Login: "deploy-bot", ID: -1, Name: "CI deploy bot", Keys: []SSHKey{testSSHKeyRSA}}
+
+	source := NewMultiKeySource(
+		&testKeySource{groups: map[string][]UserInfo{"platform": []UserInfo{user}}},
+		&testKeySource{groups: map[string][]UserInfo{"platform": []UserInfo{bot, user}, "bots": []UserInfo{bot}}},
+	)
+
+	mi, err := source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("MultiKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, []UserInfo{user, bot}) {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	mi, err = source.GetGroupMemberInfo("bots", nil)
+	if err != nil {
+		t.Fatalf("MultiKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, []UserInfo{bot}) {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	if _, err := source.GetGroupMemberInfo("unknown", nil); err != ErrTeamNotFound {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
+
+// testFileKeySource is a testKeySource whose users come from the file source.
+type testFileKeySource struct {
+	*testKeySource
+}
+
+func (testFileKeySource) userSource() string {
+	return fileKeySourceName
+}
+
+func TestMultiKeySource_GetGroupMemberInfo_sameID(t *testing.T) {
+	user := UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}}
+	bot := UserInfo{Login: "deploy-bot", ID: 999999, Source: fileKeySourceName, Name: "CI deploy bot", Keys: []SSHKey{testSSHKeyRSA}}
+
+	source := NewMultiKeySource(
+		&testKeySource{groups: map[string][]UserInfo{"platform": []UserInfo{user}}},
+		testFileKeySource{&testKeySource{groups: map[string][]UserInfo{"platform": []UserInfo{bot}}}},
+	)
+
+	mi, err := source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("MultiKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, []UserInfo{user, bot}) {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo merged users of different sources: %v", mi)
+	}
+}
+
+func TestMultiKeySource_GetGroupMemberInfo_error(t *testing.T) {
+	user := UserInfo{Login: "user", ID: 999999, Name: "User Name", Keys: []SSHKey{testSSHKey}}
+	bot := UserInfo{Login: "deploy-bot", ID: -1, Source: fileKeySourceName, Name: "CI deploy bot", Keys: []SSHKey{testSSHKeyRSA}}
+	oldBot := UserInfo{Login: "old-bot", ID: -2, Source: fileKeySourceName, Name: "Old bot", Keys: []SSHKey{testSSHKey}}
+
+	source := NewMultiKeySource(
+		testErrorKeySource{},
+		testFileKeySource{&testKeySource{groups: map[string][]UserInfo{"platform": []UserInfo{bot}}}},
+	)
+
+	// without any last known keys, the other sources are still served
+	mi, err := source.GetGroupMemberInfo("platform", nil)
+	if err != nil {
+		t.Fatalf("MultiKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, []UserInfo{bot}) {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	// the users of the failing source are kept, but not the ones of the others
+	mi, err = source.GetGroupMemberInfo("platform", []UserInfo{user, oldBot})
+	if err != nil {
+		t.Fatalf("MultiKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	staleUser := user
+	staleUser.Stale = true
+	if !reflect.DeepEqual(mi, []UserInfo{staleUser, bot}) {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+
+	if _, err := NewMultiKeySource(testErrorKeySource{}).GetGroupMemberInfo("platform", []UserInfo{user}); err == nil {
+		t.Errorf("MultiKeySource.GetGroupMemberInfo should have returned an error when no source succeeded")
+	}
+}
@@ -0,0 +1,290 @@
+package gskp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	// ldapKeySourceName is the Source of the users of an LdapKeySource.
+	ldapKeySourceName = "ldap"
+
+	// ldapConnectTimeout is how long to wait for the connection to the LDAP
+	// server, including the TLS handshake.
+	ldapConnectTimeout = 10 * time.Second
+
+	// ldapRequestTimeout is how long to wait for the response to a single
+	// LDAP request.
+	ldapRequestTimeout = 30 * time.Second
+)
+
+var (
+	ldapGroupAttributes = []string{"cn", "member", "uniqueMember", "memberUid"}
+	ldapUserAttributes  = []string{"uid", "cn", "uidNumber", "sshPublicKey"}
+)
+
+// LdapConfig holds the settings that are used to connect to an LDAP server.
+// Address is in host:port format. If UseTLS is set, the connection is made
+// over TLS (ldaps), otherwise StartTLS can be used to upgrade it. SearchBase
+// is used when looking up groups by name and users by uid.
+type LdapConfig struct {
+	Address      string
+	UseTLS       bool
+	StartTLS     bool
+	BindDN       string
+	BindPassword string
+	SearchBase   string
+}
+
+// LdapKeySource is a KeySource that maps LDAP groups to their members and
+// reads the SSH keys from the sshPublicKey attribute of the openssh-lpk
+// schema. Groups can be specified by their DN or by their cn, in which case
+// they are searched for under the SearchBase. Members are read from the
+// member and uniqueMember (DNs) or memberUid (uids) attributes of the group.
+//
+// The uidNumber of a user is used as the ID, and the Source of the users is
+// "ldap", so that they are never mistaken for GitHub users with the same ID.
+type LdapKeySource struct {
+	config LdapConfig
+	dial   func() (ldapConn, error)
+}
+
+// ldapConn is the subset of *ldap.Conn used by the LdapKeySource.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// NewLdapKeySource returns an LdapKeySource that will use the provided
+// configuration. A new connection is made for every group lookup.
+func NewLdapKeySource(config LdapConfig) *LdapKeySource {
+	s := &LdapKeySource{
+		config: config,
+	}
+	s.dial = s.dialServer
+
+	return s
+}
+
+func (s *LdapKeySource) userSource() string {
+	return ldapKeySourceName
+}
+
+// GetGroupMemberInfo returns the members of the LDAP group, along with their
+// SSH keys. If the group does not exist, ErrTeamNotFound is returned. If a
+// member cannot be looked up, their entry in lastKnown is used instead and
+// marked as stale. Members are matched to lastKnown by their uid, which is
+// taken from the first RDN of member DNs.
+func (s *LdapKeySource) GetGroupMemberInfo(groupName string, lastKnown []UserInfo) ([]UserInfo, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	group, err := s.findGroup(conn, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	simplelog.Debugf("Fetching members of LDAP group '%s'", group.DN)
+
+	lastKnownByLogin := map[string]UserInfo{}
+	for _, ui := range lastKnown {
+		lastKnownByLogin[ui.Login] = ui
+	}
+
+	users := []UserInfo{}
+
+	// addMember adds the user of the entry, or the last known keys of the
+	// member if the lookup failed
+	addMember := func(member string, login string, entry *ldap.Entry, err error) {
+		if err == nil {
+			users = append(users, ldapUserInfo(entry))
+			return
+		}
+
+		if previous, hasPrevious := lastKnownByLogin[login]; login != "" && hasPrevious && len(previous.Keys) > 0 {
+			simplelog.Infof("Could not fetch LDAP user '%s', using last known keys: %v", member, err)
+			previous.Stale = true
+			users = append(users, previous)
+			return
+		}
+
+		simplelog.Infof("Could not fetch LDAP user '%s': %v", member, err)
+	}
+
+	for _, dn := range append(group.GetAttributeValues("member"), group.GetAttributeValues("uniqueMember")...) {
+		entry, err := s.searchOne(conn, dn, ldap.ScopeBaseObject, "(objectClass=*)", ldapUserAttributes)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && entry == nil) {
+			simplelog.Infof("Member '%s' of LDAP group '%s' does not exist, skipping", dn, group.DN)
+			continue
+		}
+
+		addMember(dn, ldapDNLogin(dn), entry, err)
+	}
+
+	for _, uid := range group.GetAttributeValues("memberUid") {
+		entry, err := s.searchOne(conn, s.config.SearchBase, ldap.ScopeWholeSubtree, fmt.Sprintf("(&(objectClass=posixAccount)(uid=%s))", ldap.EscapeFilter(uid)), ldapUserAttributes)
+		if err == nil && entry == nil {
+			simplelog.Infof("Member '%s' of LDAP group '%s' does not exist, skipping", uid, group.DN)
+			continue
+		}
+
+		addMember(uid, uid, entry, err)
+	}
+
+	memberInfo := []UserInfo{}
+	seenUsers := map[int]bool{}
+
+	for _, ui := range users {
+		if seenUsers[ui.ID] {
+			continue
+		}
+		seenUsers[ui.ID] = true
+
+		if len(ui.Keys) == 0 {
+			simplelog.Infof("No public SSH keys for LDAP user '%s'", ui.Login)
+			continue
+		}
+
+		memberInfo = append(memberInfo, ui)
+	}
+
+	return memberInfo, nil
+}
+
+// findGroup returns the entry of the group, which is either looked up by DN
+// or searched for by cn under the SearchBase.
+func (s *LdapKeySource) findGroup(conn ldapConn, groupName string) (*ldap.Entry, error) {
+	var entry *ldap.Entry
+	var err error
+
+	if strings.Contains(groupName, "=") {
+		entry, err = s.searchOne(conn, groupName, ldap.ScopeBaseObject, "(objectClass=*)", ldapGroupAttributes)
+	} else {
+		filter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=posixGroup))(cn=%s))", ldap.EscapeFilter(groupName))
+		entry, err = s.searchOne(conn, s.config.SearchBase, ldap.ScopeWholeSubtree, filter, ldapGroupAttributes)
+	}
+
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && entry == nil) {
+		return nil, ErrTeamNotFound
+	}
+
+	return entry, err
+}
+
+// searchOne runs a search and returns the first entry found, or nil if there
+// are no results.
+func (s *LdapKeySource) searchOne(conn ldapConn, baseDN string, scope int, filter string, attributes []string) (*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 0, 0, false, filter, attributes, nil)
+
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+
+	return res.Entries[0], nil
+}
+
+func (s *LdapKeySource) dialServer() (ldapConn, error) {
+	host, _, err := net.SplitHostPort(s.config.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := &net.Dialer{Timeout: ldapConnectTimeout}
+
+	var netConn net.Conn
+	if s.config.UseTLS {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", s.config.Address, tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", s.config.Address)
+	}
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	conn := ldap.NewConn(netConn, s.config.UseTLS)
+	conn.Start()
+	conn.SetTimeout(ldapRequestTimeout)
+
+	if s.config.StartTLS && !s.config.UseTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if s.config.BindDN != "" {
+		if err := conn.Bind(s.config.BindDN, s.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ldapDNLogin returns the uid in the first RDN of the DN, or an empty string
+// if the DN does not start with a uid.
+func ldapDNLogin(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "uid") {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
+
+// ldapUserInfo converts an LDAP user entry to a UserInfo struct. The uidNumber
+// is used as the ID, falling back to an ID derived from the login.
+func ldapUserInfo(entry *ldap.Entry) UserInfo {
+	ui := UserInfo{
+		Login:  entry.GetAttributeValue("uid"),
+		Source: ldapKeySourceName,
+		Name:   entry.GetAttributeValue("cn"),
+		Keys:   []SSHKey{},
+	}
+
+	if ui.Login == "" {
+		ui.Login = ui.Name
+	}
+
+	if id, err := strconv.Atoi(entry.GetAttributeValue("uidNumber")); err == nil {
+		ui.ID = id
+	} else {
+		ui.ID = staticUserID(ui.Login)
+	}
+
+	for _, line := range entry.GetAttributeValues("sshPublicKey") {
+		key, err := ParseSSHKey(line)
+		if err != nil {
+			simplelog.Infof("Rejected invalid SSH key for LDAP user '%s': %v", ui.Login, err)
+			continue
+		}
+
+		ui.Keys = append(ui.Keys, key)
+	}
+
+	return ui
+}
@@ -0,0 +1,156 @@
+package gskp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+	"gopkg.in/ldap.v2"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+// testLdapConn is a fake LDAP connection that serves a fixed directory
+type testLdapConn struct {
+	entries map[string]*ldap.Entry
+	failing map[string]bool
+}
+
+func (c *testLdapConn) Bind(username, password string) error {
+	return nil
+}
+
+func (c *testLdapConn) Close() {}
+
+func (c *testLdapConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+
+	for member := range c.failing {
+		if strings.Contains(req.BaseDN, member) || strings.Contains(req.Filter, member) {
+			return nil, ldap.NewError(ldap.LDAPResultUnavailable, nil)
+		}
+	}
+
+	if req.Scope == ldap.ScopeBaseObject {
+		entry, exists := c.entries[req.BaseDN]
+		if !exists {
+			return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, nil)
+		}
+		res.Entries = append(res.Entries, entry)
+
+		return res, nil
+	}
+
+	// only the searches made by LdapKeySource are supported, which always
+	// end with (cn=...) or (uid=...)
+	i := strings.LastIndex(req.Filter, "(")
+	attrValue := strings.SplitN(strings.TrimRight(req.Filter[i+1:], ")"), "=", 2)
+
+	for dn, entry := range c.entries {
+		if strings.HasSuffix(dn, req.BaseDN) && entry.GetAttributeValue(attrValue[0]) == attrValue[1] {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+
+	return res, nil
+}
+
+func newTestLdapEntry(dn string, attributes map[string][]string) *ldap.Entry {
+	entry := &ldap.Entry{DN: dn}
+	for name, values := range attributes {
+		entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{Name: name, Values: values})
+	}
+
+	return entry
+}
+
+func newTestLdapKeySource() *LdapKeySource {
+	conn := &testLdapConn{
+		entries: map[string]*ldap.Entry{
+			"cn=infra,ou=groups,dc=example,dc=com": newTestLdapEntry("cn=infra,ou=groups,dc=example,dc=com", map[string][]string{
+				"cn":        {"infra"},
+				"member":    {"uid=alice,ou=people,dc=example,dc=com", "uid=gone,ou=people,dc=example,dc=com", "uid=nokeys,ou=people,dc=example,dc=com"},
+				"memberUid": {"bob", "alice"},
+			}),
+			"uid=alice,ou=people,dc=example,dc=com": newTestLdapEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":          {"alice"},
+				"cn":           {"Alice"},
+				"uidNumber":    {"1001"},
+				"sshPublicKey": {testPublicKey, "ssh-rsa broken"},
+			}),
+			"uid=bob,ou=people,dc=example,dc=com": newTestLdapEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":          {"bob"},
+				"cn":           {"Bob"},
+				"sshPublicKey": {testSSHKeyRSA.String()},
+			}),
+			"uid=nokeys,ou=people,dc=example,dc=com": newTestLdapEntry("uid=nokeys,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":       {"nokeys"},
+				"cn":        {"No Keys"},
+				"uidNumber": {"1003"},
+			}),
+		},
+	}
+
+	source := NewLdapKeySource(LdapConfig{SearchBase: "dc=example,dc=com"})
+	source.dial = func() (ldapConn, error) {
+		return conn, nil
+	}
+
+	return source
+}
+
+func TestLdapKeySource_GetGroupMemberInfo(t *testing.T) {
+	source := newTestLdapKeySource()
+
+	miExpected := []UserInfo{
+		UserInfo{Login: "alice", ID: 1001, Source: ldapKeySourceName, Name: "Alice", Keys: []SSHKey{testSSHKey}},
+		UserInfo{Login: "bob", ID: staticUserID("bob"), Source: ldapKeySourceName, Name: "Bob", Keys: []SSHKey{testSSHKeyRSA}},
+	}
+
+	for _, group := range []string{"infra", "cn=infra,ou=groups,dc=example,dc=com"} {
+		mi, err := source.GetGroupMemberInfo(group, nil)
+		if err != nil {
+			t.Fatalf("LdapKeySource.GetGroupMemberInfo returned an error for '%s': %v", group, err)
+		}
+
+		if !reflect.DeepEqual(mi, miExpected) {
+			t.Errorf("LdapKeySource.GetGroupMemberInfo returned unexpected value for '%s': %v", group, mi)
+		}
+	}
+}
+
+func TestLdapKeySource_GetGroupMemberInfo_notFound(t *testing.T) {
+	source := newTestLdapKeySource()
+
+	for _, group := range []string{"unknown", "cn=unknown,ou=groups,dc=example,dc=com"} {
+		if _, err := source.GetGroupMemberInfo(group, nil); err != ErrTeamNotFound {
+			t.Errorf("LdapKeySource.GetGroupMemberInfo should have returned ErrTeamNotFound for '%s' but instead got: %v", group, err)
+		}
+	}
+}
+
+func TestLdapKeySource_GetGroupMemberInfo_lastKnownKeys(t *testing.T) {
+	source := newTestLdapKeySource()
+	conn, _ := source.dial()
+	conn.(*testLdapConn).failing = map[string]bool{"alice": true, "bob": true}
+
+	lastKnown := []UserInfo{
+		UserInfo{Login: "alice", ID: 1001, Source: ldapKeySourceName, Name: "Alice", Keys: []SSHKey{testSSHKeyRSA}},
+	}
+
+	miExpected := []UserInfo{
+		UserInfo{Login: "alice", ID: 1001, Source: ldapKeySourceName, Name: "Alice", Keys: []SSHKey{testSSHKeyRSA}, Stale: true},
+	}
+
+	mi, err := source.GetGroupMemberInfo("infra", lastKnown)
+	if err != nil {
+		t.Fatalf("LdapKeySource.GetGroupMemberInfo returned an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mi, miExpected) {
+		t.Errorf("LdapKeySource.GetGroupMemberInfo returned unexpected value: %v", mi)
+	}
+}
@@ -0,0 +1,103 @@
+package gskp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// defaultProfileCacheTTL is how long the profiles of GitHub users are
+	// cached for. Profiles only provide the display name, which rarely changes.
+	defaultProfileCacheTTL = 24 * time.Hour
+
+	// profileCacheStaleFactor is how many TTLs an expired profile is kept for,
+	// to be used if the profile cannot be fetched again. Older profiles are
+	// dropped, so that users who left every team do not stay cached forever.
+	profileCacheStaleFactor = 2
+)
+
+// profileCache caches the display names of GitHub users, independently of
+// team membership and keys. Entries older than profileCacheStaleFactor TTLs
+// are swept when a profile is stored, at most once per TTL. A nil
+// profileCache caches nothing.
+type profileCache struct {
+	entries   map[int]profileCacheEntry
+	ttl       time.Duration
+	lastSweep time.Time
+	mutex     *sync.Mutex
+}
+
+type profileCacheEntry struct {
+	Name      string
+	FetchedAt time.Time
+}
+
+func newProfileCache(ttl time.Duration) *profileCache {
+	return &profileCache{
+		entries:   map[int]profileCacheEntry{},
+		ttl:       ttl,
+		lastSweep: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Get returns the cached name of the user. fresh is false if the entry is
+// older than the TTL, in which case the name should only be used if the
+// profile cannot be fetched again.
+func (c *profileCache) Get(userID int) (name string, exists bool, fresh bool) {
+	if c == nil {
+		return "", false, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exists := c.entries[userID]
+	if !exists {
+		return "", false, false
+	}
+
+	return entry.Name, true, time.Since(entry.FetchedAt) < c.ttl
+}
+
+// Set stores the name of the user.
+func (c *profileCache) Set(userID int, name string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= c.ttl {
+		c.sweep(now)
+	}
+
+	c.entries[userID] = profileCacheEntry{Name: name, FetchedAt: now}
+}
+
+// sweep drops the entries that are too old to be used even as a fallback. It
+// must be called with the mutex held.
+func (c *profileCache) sweep(now time.Time) {
+	maxAge := profileCacheStaleFactor * c.ttl
+	for userID, entry := range c.entries {
+		if now.Sub(entry.FetchedAt) >= maxAge {
+			delete(c.entries, userID)
+		}
+	}
+
+	c.lastSweep = now
+}
+
+// SetTTL changes how long profiles are cached for.
+func (c *profileCache) SetTTL(ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ttl = ttl
+}
@@ -0,0 +1,32 @@
+package gskp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfileCache_sweep(t *testing.T) {
+	c := newProfileCache(time.Hour)
+	c.Set(1, "old")
+	c.Set(2, "expired")
+
+	c.mutex.Lock()
+	c.entries[1] = profileCacheEntry{Name: "old", FetchedAt: time.Now().Add(-3 * time.Hour)}
+	c.entries[2] = profileCacheEntry{Name: "expired", FetchedAt: time.Now().Add(-90 * time.Minute)}
+	c.lastSweep = time.Now().Add(-time.Hour)
+	c.mutex.Unlock()
+
+	c.Set(3, "new")
+
+	if _, exists, _ := c.Get(1); exists {
+		t.Error("profileCache kept an entry older than the stale limit")
+	}
+
+	if name, exists, fresh := c.Get(2); !exists || fresh || name != "expired" {
+		t.Errorf("profileCache should keep an expired entry as a fallback, got %q, %v, %v", name, exists, fresh)
+	}
+
+	if name, exists, fresh := c.Get(3); !exists || !fresh || name != "new" {
+		t.Errorf("profileCache returned unexpected value for a new entry: %q, %v, %v", name, exists, fresh)
+	}
+}
@@ -0,0 +1,243 @@
+package gskp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+const (
+	// defaultRateLimitReserve is the fraction of the rate limit that is never
+	// used, so that other users of the same credentials are not starved.
+	defaultRateLimitReserve = 0.1
+
+	// defaultRateLimitMaxWait is the longest a request will wait for the rate
+	// limit to reset before failing instead.
+	defaultRateLimitMaxWait = 15 * time.Minute
+
+	// secondaryRateLimitWait is how long to back off after hitting a secondary
+	// rate limit that did not specify a Retry-After.
+	secondaryRateLimitWait = time.Minute
+)
+
+var (
+	// ErrGithubRateLimited is returned when a request to the GitHub API would
+	// have to wait longer than the maximum wait for the rate limit to reset.
+	ErrGithubRateLimited = errors.New("GitHub API rate limit exceeded")
+)
+
+// RateLimitStatus describes the state of the GitHub API rate limit, as last
+// reported by GitHub. BackoffUntil is set when requests are being held back
+// after hitting a rate limit.
+type RateLimitStatus struct {
+	Limit        int       `json:"limit"`
+	Remaining    int       `json:"remaining"`
+	Reset        time.Time `json:"reset"`
+	BackoffUntil time.Time `json:"backoff_until"`
+}
+
+// RateLimitReporter is implemented by KeySources that are subject to an API
+// rate limit.
+type RateLimitReporter interface {
+	RateLimit() RateLimitStatus
+}
+
+// rateLimiter is an http.RoundTripper that tracks the GitHub API rate limit
+// and delays requests so that it is never exhausted.
+//
+// Once less than half of the budget is left, requests are spread evenly over
+// the time left until the reset, keeping a reserve that is never used. When
+// GitHub responds with a rate limit error, requests are held back until the
+// reset time (or the Retry-After for secondary rate limits) and the failed
+// request is retried once. Waiting is cut short when the context of the
+// request is done, so callers can bound how long they are held up.
+type rateLimiter struct {
+	base    http.RoundTripper
+	mutex   *sync.Mutex
+	status  RateLimitStatus
+	next    time.Time
+	reserve float64
+	maxWait time.Duration
+	now     func() time.Time
+	sleep   func(context.Context, time.Duration) error
+}
+
+func newRateLimiter(base http.RoundTripper) *rateLimiter {
+	return &rateLimiter{
+		base:    base,
+		mutex:   &sync.Mutex{},
+		reserve: defaultRateLimitReserve,
+		maxWait: defaultRateLimitMaxWait,
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+// sleepContext waits for the duration, or until the context is done, in
+// which case the error of the context is returned.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		wait, maxWait := r.delay()
+		if wait > maxWait {
+			simplelog.Errorf("Not sending request to %s, the GitHub API rate limit resets in %s", req.URL.Path, wait)
+			return nil, ErrGithubRateLimited
+		}
+
+		if wait > 0 {
+			simplelog.Debugf("Waiting %s before sending request to %s to stay within the GitHub API rate limit", wait, req.URL.Path)
+			if err := r.sleep(req.Context(), wait); err != nil {
+				simplelog.Errorf("Gave up waiting for the GitHub API rate limit before sending request to %s: %v", req.URL.Path, err)
+				return nil, ErrGithubRateLimited
+			}
+		}
+
+		resp, err := r.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !r.update(resp) || attempt > 0 || req.Body != nil {
+			return resp, nil
+		}
+
+		if wait, maxWait := r.delay(); wait > maxWait {
+			return resp, nil
+		}
+
+		simplelog.Infof("Hit the GitHub API rate limit with request to %s, retrying after backing off", req.URL.Path)
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// Status returns the last known state of the rate limit.
+func (r *rateLimiter) Status() RateLimitStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.status
+}
+
+// SetPolicy sets the fraction of the rate limit to keep in reserve and the
+// longest a request can wait for the rate limit to reset.
+func (r *rateLimiter) SetPolicy(reserve float64, maxWait time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reserve = reserve
+	r.maxWait = maxWait
+}
+
+// delay returns how long to wait before sending the next request, along with
+// the longest that a request is allowed to wait. When requests are spread out,
+// the slot of the request is reserved by advancing next, so that concurrent
+// requests wait for their own slots instead of all waiting for the same one.
+func (r *rateLimiter) delay() (time.Duration, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+
+	if now.Before(r.status.BackoffUntil) {
+		return r.status.BackoffUntil.Sub(now), r.maxWait
+	}
+
+	if r.status.Limit == 0 || !now.Before(r.status.Reset) {
+		return 0, r.maxWait
+	}
+
+	untilReset := r.status.Reset.Sub(now)
+	reserve := int(float64(r.status.Limit) * r.reserve)
+
+	if r.status.Remaining <= reserve {
+		return untilReset, r.maxWait
+	}
+
+	if r.status.Remaining < r.status.Limit/2 {
+		if r.next.Before(now) {
+			r.next = now
+		}
+		r.next = r.next.Add(untilReset / time.Duration(r.status.Remaining-reserve))
+
+		return r.next.Sub(now), r.maxWait
+	}
+
+	return 0, r.maxWait
+}
+
+// update records the rate limit headers of a response and returns true if the
+// response was a rate limit error, in which case requests will back off.
+func (r *rateLimiter) update(resp *http.Response) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+
+	if limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit")); err == nil {
+		r.status.Limit = limit
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		r.status.Remaining = remaining
+	}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		r.status.Reset = time.Unix(reset, 0)
+	}
+
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		r.status.BackoffUntil = now.Add(time.Duration(retryAfter) * time.Second)
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		r.status.BackoffUntil = r.status.Reset
+	} else if resp.StatusCode == http.StatusTooManyRequests || isSecondaryRateLimit(resp) {
+		r.status.BackoffUntil = now.Add(secondaryRateLimitWait)
+	} else {
+		// a 403 for any other reason, eg. missing permissions
+		return false
+	}
+
+	simplelog.Infof("GitHub API rate limit exceeded, backing off until %s", r.status.BackoffUntil)
+
+	return true
+}
+
+// isSecondaryRateLimit checks the body of a 403 response for the message
+// GitHub uses for secondary (abuse) rate limits. The body is restored so that
+// it can still be read by the caller.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	message := strings.ToLower(string(body))
+
+	return strings.Contains(message, "secondary rate limit") || strings.Contains(message, "abuse detection")
+}
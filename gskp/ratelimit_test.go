@@ -0,0 +1,310 @@
+package gskp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns a rateLimiter for requests to the server, with a
+// fake clock that is advanced by sleeping instead of actually sleeping.
+func newTestRateLimiter(now time.Time) (*rateLimiter, *[]time.Duration) {
+	sleeps := []time.Duration{}
+
+	r := newRateLimiter(http.DefaultTransport)
+	r.now = func() time.Time { return now }
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	return r, &sleeps
+}
+
+func setTestRateLimitHeaders(w http.ResponseWriter, limit int, remaining int, reset time.Time) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+func TestRateLimiter_spreadsRequests(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	reset := now.Add(time.Hour)
+	remaining := 5000
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setTestRateLimitHeaders(w, 5000, remaining, reset)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	r, sleeps := newTestRateLimiter(now)
+	client := &http.Client{Transport: r}
+
+	// plenty of budget left, requests are not delayed
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(server.URL); err != nil {
+			t.Fatalf("request returned an error: %v", err)
+		}
+	}
+
+	if len(*sleeps) != 0 {
+		t.Errorf("requests were delayed with a full budget: %v", *sleeps)
+	}
+
+	// less than half left: the 1500 requests above the reserve of 500 are
+	// spread over the hour until the reset
+	remaining = 2000
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(server.URL); err != nil {
+			t.Fatalf("request returned an error: %v", err)
+		}
+	}
+
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Hour/1500 {
+		t.Errorf("unexpected delays with half the budget left: %v", *sleeps)
+	}
+
+	status := r.Status()
+	if status.Limit != 5000 || status.Remaining != 2000 || !status.Reset.Equal(reset) {
+		t.Errorf("unexpected rate limit status: %+v", status)
+	}
+
+	// concurrent requests each wait for their own slot, with a clock that
+	// does not move while they are waiting
+	r = newRateLimiter(http.DefaultTransport)
+	r.now = func() time.Time { return now }
+	r.status = RateLimitStatus{Limit: 5000, Remaining: 2000, Reset: now.Add(time.Hour)}
+
+	mutex := &sync.Mutex{}
+	waits := map[time.Duration]bool{}
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		waits[d] = true
+		return nil
+	}
+
+	client = &http.Client{Transport: r}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Get(server.URL); err != nil {
+				t.Errorf("request returned an error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 1; i <= 10; i++ {
+		if !waits[time.Duration(i)*time.Hour/1500] {
+			t.Errorf("concurrent requests did not wait for separate slots: %v", waits)
+			break
+		}
+	}
+}
+
+func TestRateLimiter_reserve(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	reset := now.Add(10 * time.Minute)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		setTestRateLimitHeaders(w, 5000, 500, reset)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	r, sleeps := newTestRateLimiter(now)
+	client := &http.Client{Transport: r}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(server.URL); err != nil {
+			t.Fatalf("request returned an error: %v", err)
+		}
+	}
+
+	if len(*sleeps) != 1 || (*sleeps)[0] != 10*time.Minute {
+		t.Errorf("expected to wait for the reset once the reserve was reached: %v", *sleeps)
+	}
+
+	// a reset too far away fails instead of waiting
+	r.SetPolicy(0.1, 5*time.Minute)
+	reset = now.Add(time.Hour)
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatalf("request returned an error: %v", err)
+	}
+
+	if _, err := client.Get(server.URL); err == nil {
+		t.Errorf("request should have failed instead of waiting for the reset")
+	}
+
+	if requests != 3 {
+		t.Errorf("unexpected number of requests sent: %d", requests)
+	}
+}
+
+func TestRateLimiter_backoff(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	testCases := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+		wait    time.Duration
+	}{
+		{
+			name: "primary",
+			handler: func(w http.ResponseWriter) {
+				setTestRateLimitHeaders(w, 5000, 0, now.Add(3*time.Minute))
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message": "API rate limit exceeded for user ID 1."}`)
+			},
+			wait: 3 * time.Minute,
+		},
+		{
+			name: "retry after",
+			handler: func(w http.ResponseWriter) {
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit."}`)
+			},
+			wait: 30 * time.Second,
+		},
+		{
+			name: "secondary",
+			handler: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit."}`)
+			},
+			wait: secondaryRateLimitWait,
+		},
+		{
+			name: "too many requests",
+			handler: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			wait: secondaryRateLimitWait,
+		},
+	}
+
+	for _, tc := range testCases {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				tc.handler(w)
+				return
+			}
+			fmt.Fprint(w, `{"ok": true}`)
+		}))
+
+		r, sleeps := newTestRateLimiter(now)
+		resp, err := (&http.Client{Transport: r}).Get(server.URL)
+		if err != nil {
+			t.Fatalf("%s: request returned an error: %v", tc.name, err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != `{"ok": true}` {
+			t.Errorf("%s: request was not retried: %d %s", tc.name, resp.StatusCode, body)
+		}
+
+		if len(*sleeps) != 1 || (*sleeps)[0] != tc.wait {
+			t.Errorf("%s: unexpected backoff: %v", tc.name, *sleeps)
+		}
+	}
+}
+
+func TestRateLimiter_waitCancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	r := newRateLimiter(http.DefaultTransport)
+	r.status.BackoffUntil = time.Now().Add(10 * time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := r.RoundTrip(req.WithContext(ctx)); err != ErrGithubRateLimited {
+		t.Errorf("rateLimiter.RoundTrip returned unexpected error: %v", err)
+	}
+
+	if requests != 0 {
+		t.Errorf("the request was sent after the context was done")
+	}
+}
+
+func TestRateLimiter_forbidden(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "Must have admin rights to Repository."}`)
+	}))
+	defer server.Close()
+
+	r, sleeps := newTestRateLimiter(time.Now())
+	resp, err := (&http.Client{Transport: r}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request returned an error: %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if requests != 1 || len(*sleeps) != 0 {
+		t.Errorf("a permission error should not be retried: %d requests, delays %v", requests, *sleeps)
+	}
+
+	if string(body) != `{"message": "Must have admin rights to Repository."}` {
+		t.Errorf("response body was not preserved: %s", body)
+	}
+}
+
+type testRateLimitSource struct {
+	testKeySource
+	status RateLimitStatus
+}
+
+func (s *testRateLimitSource) RateLimit() RateLimitStatus {
+	return s.status
+}
+
+func TestServer_statusRateLimit(t *testing.T) {
+	reset := time.Unix(1500000000, 0).UTC()
+	source := &testRateLimitSource{status: RateLimitStatus{Limit: 5000, Remaining: 1234, Reset: reset}}
+
+	s, _ := NewServer(NewKeyCache(NewMultiKeySource(&testKeySource{}, source), time.Minute))
+
+	w := httptest.NewRecorder()
+	s.statusHandler(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	status := struct {
+		RateLimit *RateLimitStatus `json:"github_rate_limit"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("could not parse status response: %v", err)
+	}
+
+	if status.RateLimit == nil || status.RateLimit.Remaining != 1234 || !status.RateLimit.Reset.Equal(reset) {
+		t.Errorf("unexpected rate limit in status response: %s", w.Body.String())
+	}
+}
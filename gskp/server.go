@@ -2,11 +2,11 @@ package gskp
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"gopkg.in/tylerb/graceful.v1"
@@ -19,15 +19,30 @@ const (
 	updateManagerInterval = time.Second
 
 	defaultLongpollTimeoutDuration = 2 * time.Minute
+
+	// defaultStreamHeartbeatInterval is how often a heartbeat is sent on an
+	// idle stream, so that clients and proxies can tell the connection is
+	// still alive.
+	defaultStreamHeartbeatInterval = 30 * time.Second
+
+	// serverVersionHeader holds the version of the keys in a response. Clients
+	// send it back in the version parameter of a longpoll request, which is
+	// answered straight away if the keys have changed since.
+	serverVersionHeader = "X-Keys-Version"
 )
 
 var (
 	serverInvalidParamTeam    = HTTPResponse{"error": "invalid team value"}
 	serverInvalidParamInit    = HTTPResponse{"error": "invalid init value"}
 	serverInvalidParamTimeout = HTTPResponse{"error": "invalid timeout value"}
+	serverInvalidParamFrom    = HTTPResponse{"error": "invalid from value"}
+	serverInvalidParamTo      = HTTPResponse{"error": "invalid to value"}
+	serverVersionNotFound     = HTTPResponse{"error": "version not found"}
+	serverTeamNotFound        = HTTPResponse{"error": "team not found"}
 	serverInvalidMethod       = HTTPResponse{"error": "invalid method"}
 	serverUnexpectedError     = HTTPResponse{"error": "unexpected error occurred"}
 	serverLongpollTimeout     = HTTPResponse{"error": "long polling has timed out"}
+	serverStreamUnsupported   = HTTPResponse{"error": "streaming is not supported"}
 )
 
 // HTTPResponse can be used to construct a response for an endpoint. It
@@ -48,8 +63,9 @@ type Server struct {
 	mux                      *http.ServeMux
 	server                   *graceful.Server
 	updateManagerStop        chan bool
-	updateManagerQueue       map[string]map[string]chan bool
-	updateManagerQueueMuxtex *sync.Mutex
+	updateManagerBroadcaster *teamBroadcaster
+	streamHeartbeatInterval  time.Duration
+	streamStop               chan struct{}
 }
 
 // NewServer returns an instantiated Server which will use the provided
@@ -61,12 +77,16 @@ func NewServer(cache *KeyCache) (*Server, error) {
 		cache:                    cache,
 		mux:                      mux,
 		updateManagerStop:        make(chan bool),
-		updateManagerQueue:       map[string]map[string]chan bool{},
-		updateManagerQueueMuxtex: &sync.Mutex{},
+		updateManagerBroadcaster: newTeamBroadcaster(),
+		streamHeartbeatInterval:  defaultStreamHeartbeatInterval,
+		streamStop:               make(chan struct{}),
 	}
 
 	mux.HandleFunc("/status", ret.statusHandler)
 	mux.HandleFunc("/keys", ret.keysHandler)
+	mux.HandleFunc("/keys/stream", ret.streamHandler)
+	mux.HandleFunc("/keys/diff", ret.diffHandler)
+	mux.HandleFunc("/teams", ret.teamsHandler)
 
 	return ret, nil
 }
@@ -95,6 +115,8 @@ func (s *Server) Start(listenAddress string, timeout time.Duration) error {
 func (s *Server) Stop(timeout time.Duration) {
 	simplelog.Infof("HTTP server shutdown started with a timeout of %.0f seconds", timeout.Seconds())
 
+	// streams never end on their own
+	close(s.streamStop)
 	s.server.Stop(timeout)
 	<-s.server.StopChan()
 	simplelog.Infof("HTTP server shutdown complete")
@@ -108,34 +130,18 @@ func (s *Server) updateManager() {
 
 	for {
 		select {
-		case team := <-s.cache.Updates:
-			simplelog.Infof("received update message for team '%s', notifying clients", team)
-
-			s.updateManagerQueueMuxtex.Lock()
-			_, exists := s.updateManagerQueue[team]
-			if exists {
-				for _, notifier := range s.updateManagerQueue[team] {
-					select {
-					case notifier <- true:
-					default:
-					}
+		case <-s.cache.Updates:
+			for _, team := range s.cache.UpdatedTeams() {
+				simplelog.Infof("received update message for team '%s', notifying clients", team)
+
+				if notified := s.updateManagerBroadcaster.Notify(team); notified > 0 {
+					simplelog.Debugf("notified %d clients", notified)
+				} else {
+					simplelog.Debugf("no clients are polling for team '%s'", team)
 				}
-
-				simplelog.Debugf("notified %d clients", len(s.updateManagerQueue[team]))
-			} else {
-				simplelog.Debugf("no clients are polling for team '%s'", team)
 			}
-			s.updateManagerQueueMuxtex.Unlock()
 		case <-cacheRefresh.C:
-			s.updateManagerQueueMuxtex.Lock()
-			teamsListening := []string{}
-			for t := range s.updateManagerQueue {
-				if len(s.updateManagerQueue[t]) > 0 {
-					teamsListening = append(teamsListening, t)
-				}
-			}
-			s.updateManagerQueueMuxtex.Unlock()
-
+			teamsListening := s.updateManagerBroadcaster.Teams()
 			if len(teamsListening) > 0 {
 				simplelog.Infof("refreshing entries in the cache for teams: %s", strings.Join(teamsListening, ", "))
 				for _, t := range teamsListening {
@@ -149,42 +155,47 @@ func (s *Server) updateManager() {
 	}
 }
 
-func (s *Server) updateManagerGetNotifier(teamName string) (string, chan bool) {
-	notifier := make(chan bool)
-	notifierID := xid.New().String()
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.respond(w, http.StatusMethodNotAllowed, serverInvalidMethod)
+		return
+	}
+
+	status := HTTPResponse{
+		"status":  "ok",
+		"image":   os.Getenv("UW_IMAGE_NAME"),
+		"git_sha": os.Getenv("UW_GIT_SHA"),
+	}
 
-	s.updateManagerQueueMuxtex.Lock()
-	if _, exists := s.updateManagerQueue[teamName]; !exists {
-		s.updateManagerQueue[teamName] = map[string]chan bool{}
+	if staleTeams := s.cache.StaleTeams(); len(staleTeams) > 0 {
+		status["status"] = "degraded"
+		status["stale_teams"] = staleTeams
 	}
-	s.updateManagerQueue[teamName][notifierID] = notifier
-	s.updateManagerQueueMuxtex.Unlock()
 
-	return notifierID, notifier
-}
+	for _, source := range flattenKeySources(s.cache.source) {
+		if rl, ok := source.(RateLimitReporter); ok && rl.RateLimit().Limit > 0 {
+			status["github_rate_limit"] = rl.RateLimit()
+		}
 
-func (s *Server) updateManagerRemoveNotifier(teamName string, notifierID string) {
-	s.updateManagerQueueMuxtex.Lock()
-	close(s.updateManagerQueue[teamName][notifierID])
-	delete(s.updateManagerQueue[teamName], notifierID)
-	s.updateManagerQueueMuxtex.Unlock()
+		if hc, ok := source.(HTTPCacheReporter); ok {
+			if stats := hc.HTTPCacheStats(); stats.Hits+stats.Misses > 0 {
+				status["github_http_cache"] = stats
+			}
+		}
+	}
+
+	s.respond(w, http.StatusOK, status)
 }
 
-func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+// teamsHandler responds with the teams the collector has keys for, like the
+// ListTeams call of the gRPC API.
+func (s *Server) teamsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		s.respond(w, http.StatusMethodNotAllowed, serverInvalidMethod)
 		return
 	}
 
-	s.respond(
-		w,
-		http.StatusOK,
-		HTTPResponse{
-			"status":  "ok",
-			"image":   os.Getenv("UW_IMAGE_NAME"),
-			"git_sha": os.Getenv("UW_GIT_SHA"),
-		},
-	)
+	s.respond(w, http.StatusOK, HTTPResponse{"teams": s.cache.Teams()})
 }
 
 func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
@@ -196,6 +207,7 @@ func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
 	team := r.URL.Query().Get("team")
 	init := r.URL.Query().Get("init")
 	timeout := r.URL.Query().Get("timeout")
+	version := r.URL.Query().Get("version")
 
 	if team == "" {
 		s.respond(w, http.StatusBadRequest, serverInvalidParamTeam)
@@ -219,8 +231,7 @@ func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
 
 	if init == "true" {
 		if err := s.sendData(w, team); err != nil {
-			simplelog.Errorf("error occurred when trying to get keys from cache: %v", err)
-			s.respond(w, http.StatusInternalServerError, serverUnexpectedError)
+			s.respondCacheError(w, err)
 			return
 		}
 
@@ -228,35 +239,241 @@ func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	timeoutTimer := time.NewTimer(timeoutDuration)
-	notifierID, notifier := s.updateManagerGetNotifier(team)
-	defer s.updateManagerRemoveNotifier(team, notifierID)
+	connectionID := xid.New().String()
+	changed, unsubscribe := s.updateManagerBroadcaster.Subscribe(team)
+	defer unsubscribe()
 
-	simplelog.Debugf("new longpoll connection '%s' from '%s' for team '%s'", notifierID, r.RemoteAddr, team)
+	// the connection subscribes before comparing versions, so that an update in
+	// between is not missed
+	if current, exists := s.cache.Version(team); exists && version != "" && version != strconv.FormatUint(current, 10) {
+		timeoutTimer.Stop()
+		simplelog.Debugf("client '%s' for team '%s' has version %s, responding with version %d", r.RemoteAddr, team, version, current)
+
+		if err := s.sendData(w, team); err != nil {
+			s.respondCacheError(w, err)
+		}
+
+		return
+	}
+
+	simplelog.Debugf("new longpoll connection '%s' from '%s' for team '%s'", connectionID, r.RemoteAddr, team)
 
 	select {
-	case <-notifier:
+	case <-changed:
 		timeoutTimer.Stop()
 
 		if err := s.sendData(w, team); err != nil {
-			simplelog.Errorf("error occurred when trying to get keys from cache: %v", err)
-			s.respond(w, http.StatusInternalServerError, serverUnexpectedError)
+			s.respondCacheError(w, err)
 			return
 		}
 	case <-timeoutTimer.C:
-		simplelog.Debugf("timing out longpoll connection '%s' from '%s' for team '%s'", notifierID, r.RemoteAddr, team)
+		simplelog.Debugf("timing out longpoll connection '%s' from '%s' for team '%s'", connectionID, r.RemoteAddr, team)
 		s.respond(w, http.StatusOK, serverLongpollTimeout)
 		return
 	}
 }
 
+// diffHandler responds with the users and keys that were added and removed
+// between the from and to versions of the keys of a team, or since the from
+// version if to is not set. Versions that are no longer in the history of the
+// cache are answered with a 404, after which clients should get the full keys
+// instead.
+func (s *Server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.respond(w, http.StatusMethodNotAllowed, serverInvalidMethod)
+		return
+	}
+
+	team := r.URL.Query().Get("team")
+	if team == "" {
+		s.respond(w, http.StatusBadRequest, serverInvalidParamTeam)
+		return
+	}
+
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		s.respond(w, http.StatusBadRequest, serverInvalidParamFrom)
+		return
+	}
+
+	var to uint64
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = strconv.ParseUint(v, 10, 64); err != nil {
+			s.respond(w, http.StatusBadRequest, serverInvalidParamTo)
+			return
+		}
+	}
+
+	// makes sure the keys of the team are in the cache
+	if _, err := s.cache.GetKeySet(team); err != nil {
+		s.respondCacheError(w, err)
+		return
+	}
+
+	diff, err := s.cache.Diff(team, from, to)
+	if err == ErrKeyVersionNotFound {
+		s.respond(w, http.StatusNotFound, serverVersionNotFound)
+		return
+	} else if err != nil {
+		simplelog.Errorf("error occurred when trying to get a diff of the keys: %v", err)
+		s.respond(w, http.StatusInternalServerError, serverUnexpectedError)
+		return
+	}
+
+	jsonText, err := json.Marshal(diff)
+	if err != nil {
+		simplelog.Errorf("error occurred when trying to encode a diff of the keys: %v", err)
+		s.respond(w, http.StatusInternalServerError, serverUnexpectedError)
+		return
+	}
+
+	simplelog.Debugf("responding to client with a diff from version %d to %d for team '%s'", diff.From, diff.To, team)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(serverVersionHeader, strconv.FormatUint(diff.To, 10))
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonText)
+}
+
+// streamHandler streams the keys of a team as Server-Sent Events over a single
+// connection. The full set of keys is sent as a "keys" event, with the version
+// as its id, first and then every time it changes. A client that reconnects
+// can send the last version it has seen, either in the version parameter or
+// in the Last-Event-ID header, in which case the keys are only sent if they
+// have changed since. Comments are sent as heartbeats while nothing changes.
+// If the team is removed, a "deleted" event is sent and the stream is closed,
+// while streams for a team that does not exist are answered with a 404.
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.respond(w, http.StatusMethodNotAllowed, serverInvalidMethod)
+		return
+	}
+
+	team := r.URL.Query().Get("team")
+	if team == "" {
+		s.respond(w, http.StatusBadRequest, serverInvalidParamTeam)
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = r.Header.Get("Last-Event-ID")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.respond(w, http.StatusInternalServerError, serverStreamUnsupported)
+		return
+	}
+
+	// make sure the team exists before committing to a stream
+	if _, err := s.cache.GetKeySet(team); err != nil {
+		s.respondCacheError(w, err)
+		return
+	}
+
+	connectionID := xid.New().String()
+	simplelog.Debugf("new stream connection '%s' from '%s' for team '%s'", connectionID, r.RemoteAddr, team)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		// subscribe before comparing versions, so that an update in between
+		// is not missed
+		changed, unsubscribe := s.updateManagerBroadcaster.Subscribe(team)
+
+		if err := s.streamKeys(w, team, &version); err != nil {
+			unsubscribe()
+			flusher.Flush()
+			simplelog.Debugf("closing stream connection '%s' from '%s' for team '%s': %v", connectionID, r.RemoteAddr, team, err)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+			unsubscribe()
+		case <-heartbeat.C:
+			unsubscribe()
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			unsubscribe()
+			simplelog.Debugf("stream connection '%s' from '%s' for team '%s' closed", connectionID, r.RemoteAddr, team)
+			return
+		case <-s.streamStop:
+			unsubscribe()
+			return
+		}
+	}
+}
+
+// streamKeys writes a "keys" event to a stream if the keys of the team in the
+// cache are not the version the client has, and updates version to the one
+// that was sent. The team is known to exist when the stream starts, so if it
+// is no longer in the cache it has been removed, in which case a "deleted"
+// event is written and ErrTeamNotFound is returned to end the stream.
+func (s *Server) streamKeys(w http.ResponseWriter, teamName string, version *string) error {
+	current, exists := s.cache.Version(teamName)
+	if !exists {
+		if _, err := fmt.Fprintf(w, "event: deleted\ndata: %s\n\n", serverTeamNotFound.Marshal()); err != nil {
+			return err
+		}
+
+		simplelog.Debugf("sent the removal of team '%s' to a stream", teamName)
+
+		return ErrTeamNotFound
+	}
+
+	if strconv.FormatUint(current, 10) == *version {
+		return nil
+	}
+
+	set, err := s.cache.GetKeySet(teamName)
+	if err != nil {
+		return err
+	}
+
+	sent := strconv.FormatUint(set.Version, 10)
+	if _, err := fmt.Fprintf(w, "id: %s\nevent: keys\ndata: %s\n\n", sent, set.JSON); err != nil {
+		return err
+	}
+
+	simplelog.Debugf("sent version %s of the keys for team '%s' to a stream", sent, teamName)
+	*version = sent
+
+	return nil
+}
+
 func (s *Server) respond(w http.ResponseWriter, code int, response HTTPResponse) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	w.Write(response.Marshal())
 }
 
+// respondCacheError responds to a request whose keys could not be read from
+// the cache. Teams that do not exist are answered with a 404, so that clients
+// can tell them apart from a failing collector.
+func (s *Server) respondCacheError(w http.ResponseWriter, err error) {
+	if err == ErrTeamNotFound {
+		s.respond(w, http.StatusNotFound, serverTeamNotFound)
+		return
+	}
+
+	simplelog.Errorf("error occurred when trying to get keys from cache: %v", err)
+	s.respond(w, http.StatusInternalServerError, serverUnexpectedError)
+}
+
 func (s *Server) sendData(w http.ResponseWriter, teamName string) error {
-	data, err := s.cache.Get(teamName)
+	set, err := s.cache.GetKeySet(teamName)
 	if err != nil {
 		return err
 	}
@@ -264,8 +481,10 @@ func (s *Server) sendData(w http.ResponseWriter, teamName string) error {
 	simplelog.Debugf("responding to client with full data for team '%s'", teamName)
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Age", strconv.Itoa(int(set.Age.Seconds())))
+	w.Header().Set(serverVersionHeader, strconv.FormatUint(set.Version, 10))
 	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	w.Write(set.JSON)
 
 	return nil
 }
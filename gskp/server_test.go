@@ -1,10 +1,17 @@
 package gskp
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,8 +24,7 @@ func init() {
 }
 
 func startNewTestServer() *Server {
-	testKeyCache = NewKeyCache("none", "", 5*time.Second)
-	testKeyCache.collector = testKeyCollector
+	testKeyCache = NewKeyCache(NewGithubKeySource(testKeyCollector, "none", 5*time.Second), 5*time.Second)
 
 	h, _ := NewServer(testKeyCache)
 
@@ -137,7 +143,7 @@ func TestServer_keys(t *testing.T) {
 	h := startNewTestServer()
 	defer h.Stop(time.Second)
 
-	dataExpected := `{"keys":[{"login":"user","id":999999,"name":"User Name","keys":"ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string"}]}`
+	dataExpected := `{"keys":[{"login":"user","id":999999,"name":"User Name","keys":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/","public_keys":[{"type":"ssh-ed25519","bits":256,"fingerprint":"SHA256:f7tjoDWr4mjTalf8ewxa3DmBV48XxT+WjHTRElWWigY","key":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/"}]}]}`
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -156,9 +162,322 @@ func TestServer_keys(t *testing.T) {
 }
 
 func TestServer_keys_erros(t *testing.T) {
+	mockSetup()
+	mockInstallHandlers([]string{"orgTeams", "userKeys", "userInfo", "teamUserList"})
+	defer mockTeardown()
+
 	h := startNewTestServer()
 	defer h.Stop(time.Second)
 
 	testGetResponse(t, "keys?init=true", `{"error":"invalid team value"}`)
 	testGetResponse(t, "keys?init=0&team=none", `{"error":"invalid init value"}`)
+	testGetResponse(t, "keys?init=true&team=invalid", `{"error":"team not found"}`)
+}
+
+func TestServer_staleKeys(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+		blocked: map[string]chan struct{}{},
+	}
+
+	cache := NewKeyCache(source, time.Minute)
+	cache.MaxStaleness = time.Hour
+	s, _ := NewServer(cache)
+
+	if _, err := cache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+
+	entry := cache.cache["deploy"]
+	entry.UpdatedAt = time.Now().Add(-90 * time.Minute)
+	cache.cache["deploy"] = entry
+
+	// keep the background update from refreshing the keys
+	source.blocked["deploy"] = make(chan struct{})
+	defer func() {
+		close(source.blocked["deploy"])
+		cache.update("deploy")
+	}()
+
+	w := httptest.NewRecorder()
+	s.keysHandler(w, httptest.NewRequest(http.MethodGet, "/keys?init=true&team=deploy", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status code for stale keys: %d", w.Code)
+	}
+
+	if age := w.Header().Get("Age"); age != "5400" {
+		t.Errorf("unexpected Age header for stale keys: %s", age)
+	}
+
+	w = httptest.NewRecorder()
+	s.statusHandler(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	status := struct {
+		Status     string   `json:"status"`
+		StaleTeams []string `json:"stale_teams"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("could not parse status response: %v", err)
+	}
+
+	if status.Status != "degraded" || len(status.StaleTeams) != 1 || status.StaleTeams[0] != "deploy" {
+		t.Errorf("unexpected status response with stale keys: %s", w.Body.String())
+	}
+}
+
+// testChangeKeys changes the keys of the team in the source and updates the
+// cache with them.
+func testChangeKeys(t *testing.T, cache *KeyCache, source *testKeySource, teamName string, name string) {
+	testChangeUsers(t, cache, source, teamName, []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: name, Keys: []SSHKey{testSSHKey}}})
+}
+
+// testChangeUsers replaces the users of the team in the source and updates
+// the cache with them.
+func testChangeUsers(t *testing.T, cache *KeyCache, source *testKeySource, teamName string, users []UserInfo) {
+	source.mutex.Lock()
+	source.groups[teamName] = users
+	source.mutex.Unlock()
+
+	cache.mutex.Lock()
+	entry := cache.cache[teamName]
+	entry.UpdatedAt = time.Time{}
+	cache.cache[teamName] = entry
+	cache.mutex.Unlock()
+
+	if err := cache.update(teamName); err != nil {
+		t.Fatalf("KeyCache.update returned an error: %v", err)
+	}
+}
+
+// testDeleteTeam removes the team from the source and updates the cache, which
+// removes the team from it too.
+func testDeleteTeam(t *testing.T, cache *KeyCache, source *testKeySource, teamName string) {
+	source.mutex.Lock()
+	delete(source.groups, teamName)
+	source.mutex.Unlock()
+
+	cache.mutex.Lock()
+	entry := cache.cache[teamName]
+	entry.UpdatedAt = time.Time{}
+	cache.cache[teamName] = entry
+	cache.mutex.Unlock()
+
+	if err := cache.update(teamName); err != ErrTeamNotFound {
+		t.Fatalf("KeyCache.update should have returned ErrTeamNotFound but instead got: %v", err)
+	}
+}
+
+// testReadEvent reads the lines of the next event or comment from a stream.
+func testReadEvent(t *testing.T, r *bufio.Reader) []string {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read from the stream: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestServer_stream(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	s, _ := NewServer(cache)
+	s.streamHeartbeatInterval = 100 * time.Millisecond
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	defer close(s.streamStop)
+
+	go s.updateManager()
+	defer func() { s.updateManagerStop <- true }()
+
+	resp, err := http.Get(ts.URL + "/keys/stream?team=deploy")
+	if err != nil {
+		t.Fatalf("could not start a stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("unexpected content type for a stream: %s", contentType)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	version, _ := cache.Version("deploy")
+	data, _ := cache.Get("deploy")
+
+	eventExpected := []string{fmt.Sprintf("id: %d", version), "event: keys", "data: " + string(data)}
+	if event := testReadEvent(t, r); !reflect.DeepEqual(event, eventExpected) {
+		t.Errorf("unexpected first event on the stream: %v", event)
+	}
+
+	if event := testReadEvent(t, r); !reflect.DeepEqual(event, []string{": heartbeat"}) {
+		t.Errorf("unexpected heartbeat on the stream: %v", event)
+	}
+
+	testChangeKeys(t, cache, source, "deploy", "Deploy Bot v2")
+
+	version, _ = cache.Version("deploy")
+	event := testReadEvent(t, r)
+	for reflect.DeepEqual(event, []string{": heartbeat"}) {
+		event = testReadEvent(t, r)
+	}
+
+	if len(event) != 3 || event[0] != fmt.Sprintf("id: %d", version) || !strings.Contains(event[2], "Deploy Bot v2") {
+		t.Errorf("unexpected update on the stream: %v", event)
+	}
+
+	// a client that reconnects with the current version only gets heartbeats
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/keys/stream?team=deploy", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprintf("%d", version))
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not resume a stream: %v", err)
+	}
+	defer resumed.Body.Close()
+
+	if event := testReadEvent(t, bufio.NewReader(resumed.Body)); !reflect.DeepEqual(event, []string{": heartbeat"}) {
+		t.Errorf("unexpected first event on a resumed stream: %v", event)
+	}
+}
+
+func TestServer_stream_deleted(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	s, _ := NewServer(cache)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	defer close(s.streamStop)
+
+	go s.updateManager()
+	defer func() { s.updateManagerStop <- true }()
+
+	resp, err := http.Get(ts.URL + "/keys/stream?team=deploy")
+	if err != nil {
+		t.Fatalf("could not start a stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	if event := testReadEvent(t, r); len(event) != 3 || event[1] != "event: keys" {
+		t.Errorf("unexpected first event on the stream: %v", event)
+	}
+
+	testDeleteTeam(t, cache, source, "deploy")
+
+	eventExpected := []string{"event: deleted", "data: " + string(serverTeamNotFound.Marshal())}
+	if event := testReadEvent(t, r); !reflect.DeepEqual(event, eventExpected) {
+		t.Errorf("unexpected event for a deleted team: %v", event)
+	}
+
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("the stream should have been closed after the team was deleted: %v", err)
+	}
+}
+
+func TestServer_stream_errors(t *testing.T) {
+	s, _ := NewServer(NewKeyCache(&testKeySource{}, time.Hour))
+
+	for url, code := range map[string]int{
+		"/keys/stream":             http.StatusBadRequest,
+		"/keys/stream?team=deploy": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		s.streamHandler(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		if w.Code != code {
+			t.Errorf("unexpected status code for %s: %d", url, w.Code)
+		}
+	}
+
+	s, _ = NewServer(NewKeyCache(testErrorKeySource{}, time.Hour))
+
+	w := httptest.NewRecorder()
+	s.streamHandler(w, httptest.NewRequest(http.MethodGet, "/keys/stream?team=deploy", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status code for a failing source: %d", w.Code)
+	}
+}
+
+func TestServer_diff(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+
+	cache := NewKeyCache(source, time.Hour)
+	s, _ := NewServer(cache)
+
+	if _, err := cache.Get("deploy"); err != nil {
+		t.Fatalf("KeyCache.Get returned an error: %v", err)
+	}
+	from, _ := cache.Version("deploy")
+
+	testChangeUsers(t, cache, source, "deploy", []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKeyRSA}}})
+	to, _ := cache.Version("deploy")
+
+	w := httptest.NewRecorder()
+	s.diffHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/keys/diff?team=deploy&from=%d", from), nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d %s", w.Code, w.Body.String())
+	}
+
+	if version := w.Header().Get(serverVersionHeader); version != strconv.FormatUint(to, 10) {
+		t.Errorf("unexpected version header: %s", version)
+	}
+
+	expected := fmt.Sprintf(`{"from":%d,"to":%d,"added_users":[],"removed_users":[],"added_keys":[{"login":"deploy-bot","type":"ssh-rsa","fingerprint":"%s"}],"removed_keys":[{"login":"deploy-bot","type":"ssh-ed25519","fingerprint":"%s"}]}`, from, to, testSSHKeyRSA.Fingerprint, testSSHKey.Fingerprint)
+	if w.Body.String() != expected {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestServer_diff_errors(t *testing.T) {
+	source := &testKeySource{
+		groups: map[string][]UserInfo{
+			"deploy": []UserInfo{UserInfo{Login: "deploy-bot", ID: 1, Name: "Deploy Bot", Keys: []SSHKey{testSSHKey}}},
+		},
+	}
+	s, _ := NewServer(NewKeyCache(source, time.Hour))
+
+	for url, code := range map[string]int{
+		"/keys/diff?from=1":                  http.StatusBadRequest,
+		"/keys/diff?team=deploy":             http.StatusBadRequest,
+		"/keys/diff?team=deploy&from=1&to=x": http.StatusBadRequest,
+		"/keys/diff?team=deploy&from=1":      http.StatusNotFound,
+		"/keys/diff?team=missing&from=0":     http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		s.diffHandler(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		if w.Code != code {
+			t.Errorf("unexpected status code for %s: %d", url, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.diffHandler(w, httptest.NewRequest(http.MethodGet, "/keys/diff?team=missing&from=0", nil))
+	if w.Body.String() != string(serverTeamNotFound.Marshal()) {
+		t.Errorf("unexpected response for a team that does not exist: %s", w.Body.String())
+	}
 }
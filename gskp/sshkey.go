@@ -0,0 +1,144 @@
+package gskp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrSSHKeyEmpty is returned when trying to parse an empty line as an SSH
+	// key.
+	ErrSSHKeyEmpty = errors.New("SSH key line is empty")
+)
+
+// SSHKey is a parsed public SSH key, as it would appear in an authorized_keys
+// file.
+type SSHKey struct {
+	Type        string `json:"type"`
+	Bits        int    `json:"bits"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	Key         string `json:"key"`
+}
+
+// String returns the key in authorized_keys format, including the comment if
+// there is one.
+func (k SSHKey) String() string {
+	if k.Comment == "" {
+		return k.Key
+	}
+
+	return k.Key + " " + k.Comment
+}
+
+// ParseSSHKey parses a single line in authorized_keys format. Options at the
+// start of the line are not supported.
+func ParseSSHKey(line string) (SSHKey, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return SSHKey{}, ErrSSHKeyEmpty
+	}
+
+	publicKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return SSHKey{}, err
+	}
+
+	if len(options) > 0 {
+		return SSHKey{}, errors.New("SSH key options are not supported")
+	}
+
+	return SSHKey{
+		Type:        publicKey.Type(),
+		Bits:        publicKeyBits(publicKey),
+		Fingerprint: publicKeyFingerprint(publicKey),
+		Comment:     comment,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+	}, nil
+}
+
+// ParseSSHKeys parses a newline separated list of SSH keys. It returns the
+// keys that were parsed successfully and an error for each line that could
+// not be parsed. Empty lines are ignored.
+func ParseSSHKeys(data string) ([]SSHKey, []error) {
+	keys := []SSHKey{}
+	errs := []error{}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		key, err := ParseSSHKey(scanner.Text())
+		if err == ErrSSHKeyEmpty {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return keys, errs
+}
+
+// joinSSHKeys returns the keys as a newline separated string, which is the
+// format that GitHub uses.
+func joinSSHKeys(keys []SSHKey) string {
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = k.String()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// publicKeyFingerprint returns the SHA256 fingerprint of the key, in the same
+// format that OpenSSH uses.
+func publicKeyFingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// publicKeyBits returns the size of the key in bits. For RSA and DSA keys the
+// size of the modulus is read from the wire format of the key.
+func publicKeyBits(key ssh.PublicKey) int {
+	switch key.Type() {
+	case ssh.KeyAlgoED25519, "sk-ssh-ed25519@openssh.com":
+		return 256
+	case ssh.KeyAlgoECDSA256, "sk-ecdsa-sha2-nistp256@openssh.com":
+		return 256
+	case ssh.KeyAlgoECDSA384:
+		return 384
+	case ssh.KeyAlgoECDSA521:
+		return 521
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoDSA:
+		// RSA keys are encoded as (type, e, n) and DSA keys as (type, p, ...)
+		var w struct {
+			Name   string
+			First  *big.Int
+			Second *big.Int
+			Rest   []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(key.Marshal(), &w); err != nil {
+			return 0
+		}
+
+		if key.Type() == ssh.KeyAlgoRSA {
+			return w.Second.BitLen()
+		}
+
+		return w.First.BitLen()
+	}
+
+	return 0
+}
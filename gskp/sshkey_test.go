@@ -0,0 +1,78 @@
+package gskp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/utilitywarehouse/github-sshkey-provider/gskp/simplelog"
+)
+
+func init() {
+	simplelog.DebugEnabled = true
+}
+
+var parseSSHKeyTests = []struct {
+	Input    string
+	Expected SSHKey
+}{
+	{testPublicKey, testSSHKey},
+	{"  " + testSSHKeyRSA.String() + "  ", testSSHKeyRSA},
+	{
+		"ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDQVtCPNBYtcZ++CjltvSpjZbo8EACwawOQGA8PFr/2oiLBK4dO+BWnaNxeYS6wyreMxIj1qlsbUxGN4QHsiwaw= some comment",
+		SSHKey{
+			Type:        "ecdsa-sha2-nistp256",
+			Bits:        256,
+			Fingerprint: "SHA256:ovFKZR94VfWPmLN49/4lq+VUxEJm9AePmhSsbDos90o",
+			Comment:     "some comment",
+			Key:         "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDQVtCPNBYtcZ++CjltvSpjZbo8EACwawOQGA8PFr/2oiLBK4dO+BWnaNxeYS6wyreMxIj1qlsbUxGN4QHsiwaw=",
+		},
+	},
+	{
+		"sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/AAAABHNzaDo= security key",
+		SSHKey{
+			Type:        "sk-ssh-ed25519@openssh.com",
+			Bits:        256,
+			Fingerprint: "SHA256:k8vBBK6xX9CglesSaZd6aMhYeT3Y17J8gqmekyL6r1g",
+			Comment:     "security key",
+			Key:         "sk-ssh-ed25519@openssh.com AAAAGnNrLXNzaC1lZDI1NTE5QG9wZW5zc2guY29tAAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/AAAABHNzaDo=",
+		},
+	},
+}
+
+func TestParseSSHKey(t *testing.T) {
+	for i, test := range parseSSHKeyTests {
+		key, err := ParseSSHKey(test.Input)
+		if err != nil {
+			t.Fatalf("ParseSSHKey returned an error for test #%d: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(key, test.Expected) {
+			t.Errorf("ParseSSHKey returned unexpected value for test #%d: %v", i, key)
+		}
+	}
+}
+
+func TestParseSSHKey_errors(t *testing.T) {
+	for i, input := range []string{
+		"",
+		"ssh-rsa this_will_be_a_really_really_really_long_ssh_key_string",
+		"not-a-key-type AAAAC3NzaC1lZDI1NTE5AAAAIGUoWYG1miejaN1zI8XqlyPEJzS+ySjWdOn+8Py6xXJ/",
+		`command="/bin/true" ` + testPublicKey,
+	} {
+		if _, err := ParseSSHKey(input); err == nil {
+			t.Errorf("ParseSSHKey should have returned an error for test #%d", i)
+		}
+	}
+}
+
+func TestParseSSHKeys(t *testing.T) {
+	keys, errs := ParseSSHKeys(testPublicKey + "\ninvalid line\n\n" + testSSHKeyRSA.String() + "\n")
+
+	if !reflect.DeepEqual(keys, []SSHKey{testSSHKey, testSSHKeyRSA}) {
+		t.Errorf("ParseSSHKeys returned unexpected keys: %v", keys)
+	}
+
+	if len(errs) != 1 {
+		t.Errorf("ParseSSHKeys returned unexpected errors: %v", errs)
+	}
+}